@@ -1,8 +1,6 @@
 package btree
 
 import (
-	"unsafe"
-
 	"github.com/Manik-Jasrai/ByteStore.git/utils"
 )
 
@@ -14,30 +12,25 @@ type C struct {
 }
 
 func newC() *C {
-	pages := map[uint64]BNode{}
-
-	return &C{
-		tree: BTree{
-			get: func(ptr uint64) []byte {
-				node, ok := pages[ptr]
-				utils.Assert(ok, "Node Exists")
-				return node
-			},
-			new: func(node []byte) uint64 {
-				utils.Assert(BNode(node).nBytes() <= BTREE_PAGE_SIZE, "Out of Bounds")
-				key := uint64(uintptr(unsafe.Pointer(&node[0])))
-				pages[key] = node
-				return key
-			},
-			del: func(ptr uint64) {
-				_, ok := pages[ptr]
-				utils.Assert(ok, "Node Exists")
-				delete(pages, ptr)
-			},
-		},
+	store := checkStore{NewMemStore()}
+	c := &C{
 		ref:   map[string]string{},
-		pages: pages,
+		pages: store.pages,
+	}
+	c.tree.SetStore(store)
+	return c
+}
+
+// Checks the nodes the tree writes fit in their page
+type checkStore struct {
+	*MemStore
+}
+
+func (store checkStore) New(page []byte) uint64 {
+	if BNode(page).bType() != BNODE_OVERFLOW {
+		utils.Assert(BNode(page).nBytes() <= len(page), "Out of Bounds")
 	}
+	return store.MemStore.New(page)
 }
 
 func (c *C) add(key string, val string) error {
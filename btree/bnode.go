@@ -21,9 +21,25 @@ func (node BNode) GetData() []byte {
 	return node
 }
 
+// Offsets are 2 bytes, nodes of pages larger than BTREE_MAX_NARROW_PAGE have 4 byte offsets
+// they are marked by BNODE_WIDE in the format byte
+const BNODE_WIDE = uint16(0x80)
+
 // Header
+// the low byte is the node type, the high byte is the format
 func (node BNode) bType() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[0:2]) & 0xff
+}
+func (node BNode) format() uint16 {
+	return binary.LittleEndian.Uint16(node[0:2]) >> 8 &^ BNODE_WIDE
+}
+func (node BNode) wide() bool {
+	return binary.LittleEndian.Uint16(node[0:2])>>8&BNODE_WIDE != 0
+}
+
+// Type and offset width, what a node built from this one starts with
+func (node BNode) kind() uint16 {
+	return binary.LittleEndian.Uint16(node[0:2]) & (0xff | BNODE_WIDE<<8)
 }
 func (node BNode) nKeys() uint16 {
 	return binary.LittleEndian.Uint16(node[2:4])
@@ -47,29 +63,43 @@ func (node BNode) setPtr(idx uint16, ptr uint64) {
 }
 
 // Offset - used to locate KV quickly
-func (node BNode) offsetPos(idx uint16) uint16 {
+func (node BNode) offsetSize() int {
+	if node.wide() {
+		return 4
+	}
+	return 2
+}
+func (node BNode) offsetPos(idx uint16) int {
 	utils.Assert(1 <= idx && idx <= node.nKeys(), "Index Out of Bounds : OffsetPos")
-	return HEADER + 8*node.nKeys() + 2*(idx-1)
+	return HEADER + 8*int(node.nKeys()) + node.offsetSize()*int(idx-1)
 }
-func (node BNode) getOffset(idx uint16) uint16 {
+func (node BNode) getOffset(idx uint16) int {
 	if idx == 0 {
 		return 0
 	}
-	return binary.LittleEndian.Uint16(node[node.offsetPos(idx):])
+	if node.wide() {
+		return int(binary.LittleEndian.Uint32(node[node.offsetPos(idx):]))
+	}
+	return int(binary.LittleEndian.Uint16(node[node.offsetPos(idx):]))
 }
-func (node BNode) setOffset(idx uint16, offset uint16) {
-	binary.LittleEndian.PutUint16(node[node.offsetPos(idx):], offset)
+func (node BNode) setOffset(idx uint16, offset int) {
+	if node.wide() {
+		binary.LittleEndian.PutUint32(node[node.offsetPos(idx):], uint32(offset))
+		return
+	}
+	utils.Assert(offset <= 0xffff, "Offset Out of Range")
+	binary.LittleEndian.PutUint16(node[node.offsetPos(idx):], uint16(offset))
 }
 
 // KV
-func (node BNode) KVPos(idx uint16) uint16 {
+func (node BNode) KVPos(idx uint16) int {
 	utils.Assert(idx <= node.nKeys(), "Index Out of Bounds : KVPos")
-	return HEADER + 8*node.nKeys() + 2*node.nKeys() + node.getOffset(idx)
+	return HEADER + (8+node.offsetSize())*int(node.nKeys()) + node.getOffset(idx)
 }
 func (node BNode) getKey(idx uint16) []byte {
 	utils.Assert(idx < node.nKeys(), "Index Out of Bounds : GetKey")
 	pos := node.KVPos(idx)
-	klen := binary.LittleEndian.Uint16(node[pos:])
+	klen := int(binary.LittleEndian.Uint16(node[pos:]))
 	return (node[pos+4:])[:klen]
 	// 1. first create a slice from pos + 4 to end
 	// 2. then it selects the first klen from it
@@ -78,40 +108,47 @@ func (node BNode) getKey(idx uint16) []byte {
 func (node BNode) getValue(idx uint16) []byte {
 	utils.Assert(idx < node.nKeys(), "Index Out of Bounds : GetValue")
 	pos := node.KVPos(idx)
-	klen := binary.LittleEndian.Uint16(node[pos:])
-	vlen := binary.LittleEndian.Uint16(node[pos+2:])
+	klen := int(binary.LittleEndian.Uint16(node[pos:]))
+	vlen := int(binary.LittleEndian.Uint16(node[pos+2:]))
 	return (node[pos+klen+4:])[:vlen]
 }
 
 // Size of Node
-func (node BNode) nBytes() uint16 {
+func (node BNode) nBytes() int {
 	return node.KVPos(node.nKeys())
 }
 
 // Search a key
 // or a pos where this key could be put
+// returns the largest idx such that key[idx] <= key
+// idx 0 is never compared, it covers everything smaller than key[1]
 func (node BNode) lookUp(key []byte) uint16 {
-	found := uint16(0)
-	for i := uint16(1); i < node.nKeys(); i++ {
-		// since keys are sorted
-		// we have to find the largest key which is smaller than new Key
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp <= 0 {
-			found = i
-		}
-		// if we have found the largest num possible then we can return
-		if cmp >= 0 {
-			break
+	return node.lookUpFunc(func(idx uint16) int {
+		return bytes.Compare(node.getKey(idx), key)
+	})
+}
+
+// Same as lookUp, cmp compares key[idx] with the searched key
+func (node BNode) lookUpFunc(cmp func(idx uint16) int) uint16 {
+	// binary search over [lo, hi)
+	// invariant : key[lo] <= key (or lo == 0)
+	lo, hi := uint16(0), node.nKeys()
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if cmp(mid) <= 0 {
+			lo = mid
+		} else {
+			hi = mid
 		}
 	}
-	return found
+	return lo
 }
 
 // Insert KV to Leaf Node
 // Create a new Node and insert the new key in it
 // Inserts at idx and shifts others
 func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
-	new.setHeader(BNODE_LEAF, old.nKeys()+1)
+	new.setHeader(old.kind(), old.nKeys()+1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, 0, key, val)
 	nodeAppendRange(new, old, idx+1, idx, old.nKeys()-idx)
@@ -119,7 +156,7 @@ func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
 
 // Updates at idx
 func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
-	new.setHeader(BNODE_LEAF, old.nKeys())
+	new.setHeader(old.kind(), old.nKeys())
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, 0, key, val)
 	nodeAppendRange(new, old, idx+1, idx+1, old.nKeys()-idx-1)
@@ -127,7 +164,7 @@ func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
 
 // Deletes KV at idx
 func leafDelete(new BNode, old BNode, idx uint16) {
-	new.setHeader(BNODE_LEAF, old.nKeys()-1)
+	new.setHeader(old.kind(), old.nKeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendRange(new, old, idx, idx+1, old.nKeys()-idx-1)
 }
@@ -165,32 +202,48 @@ func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 	binary.LittleEndian.PutUint16(new[pos:], uint16(len(key)))
 	binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(val)))
 	copy(new[pos+4:], key)
-	copy(new[pos+4+uint16(len(key)):], val)
+	copy(new[pos+4+len(key):], val)
 	// Offset for next key
-	new.setOffset(idx+1, new.getOffset(idx)+4+uint16(len(key)+len(val)))
+	new.setOffset(idx+1, new.getOffset(idx)+4+len(key)+len(val))
 }
 
 // This Function Helps to update the kids of a node
-func NodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) {
+// hi is the high fence of old, see leafFence
+func NodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, hi []byte, kids ...BNode) {
 	inc := uint16(len(kids))
-	new.setHeader(old.bType(), old.nKeys()-1+inc) // we split 1 into inc(new split)
+	new.setHeader(old.kind(), old.nKeys()-1+inc) // we split 1 into inc(new split)
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), nil)
+		count := countVal(nodeCount(tree, node))
+		ptr := tree.newNode(node, splitFence(tree, kids, i, old, idx, hi))
+		nodeAppendKV(new, idx+uint16(i), ptr, kidKey(tree, kids, i), count)
 	}
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nKeys()-(idx+1))
 }
 
+// Key of kids[i] in its parent
+// a split leaf only needs to be told apart from the leaf on its left
+// the last key of a node is not the largest one under it, so nodes keep the whole key
+func kidKey(tree *BTree, kids []BNode, i int) []byte {
+	key := kids[i].getKey(0)
+	if tree.compress && tree.bytewise() && i > 0 && kids[i-1].bType() == BNODE_LEAF {
+		left := kids[i-1]
+		key = keySeparator(left.getKey(left.nKeys()-1), key)
+	}
+	return key
+}
+
 // Replace 2 adjacent links with 1
-func NodeReplace2Kid(new BNode, old BNode, idx uint16, ptr uint64, key []byte) {
-	new.setHeader(old.bType(), old.nKeys()-1)
+// count is the number of keys under the new link
+func NodeReplace2Kid(new BNode, old BNode, idx uint16, ptr uint64, key []byte, count uint64) {
+	new.setHeader(old.kind(), old.nKeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, ptr, key, old.getValue(idx))
+	nodeAppendKV(new, idx, ptr, key, countVal(count))
 	nodeAppendRange(new, old, idx+1, idx+2, old.nKeys()-(idx+2))
 }
 
 func nodeMerge(new BNode, left BNode, right BNode) {
-	new.setHeader(left.bType(), left.nKeys()+right.nKeys())
+	new.setHeader(left.kind(), left.nKeys()+right.nKeys())
 	nodeAppendRange(new, left, 0, 0, left.nKeys())
 	nodeAppendRange(new, right, left.nKeys(), 0, right.nKeys())
 }
@@ -51,8 +51,8 @@ func TestBNode(t *testing.T) {
 	// Check Offsets
 	off1 := node.getOffset(0)
 	off2 := node.getOffset(1)
-	expectedOff1 := uint16(0)
-	expectedOff2 := uint16(4 + len("k1") + len("hi")) // offset from beginning of KV1 to start of KV2
+	expectedOff1 := 0
+	expectedOff2 := 4 + len("k1") + len("hi") // offset from beginning of KV1 to start of KV2
 
 	assert.Equal(t, expectedOff1, off1)
 	assert.Equal(t, expectedOff2, off2)
@@ -61,12 +61,12 @@ func TestBNode(t *testing.T) {
 	pos1 := node.KVPos(0)
 	pos2 := node.KVPos(1)
 
-	assert.Equal(t, HEADER+8*node.nKeys()+2*node.nKeys()+off1, pos1)
-	assert.Equal(t, HEADER+8*node.nKeys()+2*node.nKeys()+off2, pos2)
+	assert.Equal(t, HEADER+10*int(node.nKeys())+off1, pos1)
+	assert.Equal(t, HEADER+10*int(node.nKeys())+off2, pos2)
 
 	// Optional: check total size of node
 	size := node.nBytes()
-	assert.Greater(t, size, uint16(0))
+	assert.Greater(t, size, 0)
 }
 
 func TestLookUp(t *testing.T) {
@@ -210,8 +210,29 @@ func TestNodeReplace2Kid(t *testing.T) {
 		nodeAppendKV(node, uint16(i), 0, []byte(k), []byte(v))
 	}
 	new := BNode(make([]byte, BTREE_PAGE_SIZE))
-	NodeReplace2Kid(new, node, 2, 999, []byte("k02"))
+	NodeReplace2Kid(new, node, 2, 999, []byte("k02"), 0)
 
 	assert.Equal(t, uint16(4), new.nKeys())
 	assert.Equal(t, uint16(3), new.lookUp([]byte("k04")))
 }
+
+func TestLookUpFullPage(t *testing.T) {
+	var keys [][]byte
+	var vals [][]byte
+	for i := 0; i < 200; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("k%03d", 2*i)))
+		vals = append(vals, []byte("v"))
+	}
+	node := CreateLeafwithKVs(keys, vals)
+
+	for i := 0; i < 200; i++ {
+		// Exact match
+		assert.Equal(t, uint16(i), node.lookUp([]byte(fmt.Sprintf("k%03d", 2*i))))
+		// In between two keys
+		assert.Equal(t, uint16(i), node.lookUp([]byte(fmt.Sprintf("k%03d", 2*i+1))))
+	}
+	// Smaller than everything falls to idx 0
+	assert.Equal(t, uint16(0), node.lookUp([]byte("a")))
+	// Larger than everything
+	assert.Equal(t, uint16(199), node.lookUp([]byte("z")))
+}
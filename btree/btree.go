@@ -7,132 +7,296 @@ import (
 	"github.com/Manik-Jasrai/ByteStore.git/utils"
 )
 
-const HEADER = 4
-const BTREE_PAGE_SIZE = 4096
+const HEADER = 8             // type, nkeys and the page checksum, see PAGE_CHECKSUM_OFFSET
+const BTREE_PAGE_SIZE = 4096 // default page size, see SetPageSize
 const BTREE_MAX_KEY_SIZE = 1000
-const BTREE_MAX_VAL_SIZE = 3000
+const BTREE_MAX_VAL_SIZE = 3000 // larger values go to overflow pages
 
 type BTree struct {
-	root uint64
+	root  uint64
+	store PageStore
 
-	get func(uint64) []byte
-	new func([]byte) uint64
-	del func(uint64)
+	longKeys bool        // store keys larger than BTREE_MAX_KEY_SIZE
+	compress bool        // write prefix compressed nodes
+	cmp      Comparator  // nil is BytewiseComparator
+	pageSize int         // 0 is BTREE_PAGE_SIZE
+	minFill  float64     // 0 is BTREE_MIN_FILL
+	split    SplitPolicy // nil is AppendSplit(BTREE_APPEND_FILL)
 }
 
-func (t BTree) GetRoot() uint64 {
-	return t.root
+func (tree *BTree) GetRoot() uint64 {
+	return tree.root
 }
 
-func (t BTree) SetRoot(root uint64) {
-	t.root = root
+func (tree *BTree) SetRoot(root uint64) {
+	tree.root = root
 }
-func (t BTree) SetGet(f func(uint64) []byte) {
-	t.get = f
+
+// Allow keys larger than BTREE_MAX_KEY_SIZE, their tails spill to overflow pages
+// files with spilled keys can not be read with long keys disabled
+func (tree *BTree) SetLongKeys(on bool) {
+	tree.longKeys = on
 }
-func (t BTree) SetDel(f func(uint64)) {
-	t.del = f
+
+// Values larger than BTREE_MAX_VAL_SIZE spill to overflow pages
+func CheckLimit(key []byte, val []byte) error {
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return ErrKeyTooLarge
+	}
+	if len(val) > OVERFLOW_MAX_SIZE {
+		return ErrValueTooLarge
+	}
+	return nil
 }
 
-func (t BTree) SetNew(f func([]byte) uint64) {
-	t.new = f
+// Returns the value of key, ErrNotFound if it does not exist
+func (tree *BTree) Get(key []byte) (val []byte, err error) {
+	defer recoverCorrupt(&err)
+	// the sentinel is not a key
+	if tree.root != 0 && len(key) > 0 {
+		val = TreeGet(tree, tree.getNode(tree.root), key)
+	}
+	if val == nil {
+		return nil, ErrNotFound
+	}
+	return val, nil
 }
 
-func CheckLimit(key []byte, val []byte) error {
-	if len(key) <= BTREE_MAX_KEY_SIZE && len(val) <= BTREE_MAX_VAL_SIZE {
-		return nil
+// Write nodes that do not fit in a page in the prefix compressed format
+// and shorten the keys of split nodes in their parent
+// files written this way can still be read with compression disabled
+func (tree *BTree) SetCompress(on bool) {
+	tree.compress = on
+}
+
+// KV limits of this tree
+func (tree *BTree) checkKV(key []byte, val []byte) error {
+	if tree.longKeys {
+		key = nil
 	}
-	return errors.New("out of bound kV")
+	return CheckLimit(key, val)
 }
 
-// TODO
-func (tree *BTree) Get(key []byte) []byte {
-	return nil
+// Search a key in a node holding stored keys
+func treeLookUp(tree *BTree, node BNode, key []byte) uint16 {
+	return node.lookUpFunc(func(idx uint16) int {
+		return keyCompare(tree, node.getKey(idx), key)
+	})
+}
+
+// Update modes
+const (
+	MODE_UPSERT      = 0 // insert or replace
+	MODE_UPDATE_ONLY = 1 // only replace existing keys
+	MODE_INSERT_ONLY = 2 // only add new keys
+	MODE_CAS         = 3 // only replace a value equal to Expected
+)
+
+// Insert or update of a key
+type UpdateReq struct {
+	Key      []byte
+	Val      []byte
+	Mode     int
+	Expected []byte // old value for MODE_CAS
+	// out
+	Added   bool   // a new key was added
+	Updated bool   // a new key was added or the value was replaced
+	Old     []byte // value before the update, nil if the key did not exist
+
+	appended bool // the key went past the last one of the tree
+}
+
+// Whether the mode allows the write, found is whether the key exists
+func (req *UpdateReq) allowed(found bool) bool {
+	switch req.Mode {
+	case MODE_UPSERT:
+		return true
+	case MODE_UPDATE_ONLY:
+		return found
+	case MODE_INSERT_ONLY:
+		return !found
+	case MODE_CAS:
+		return found && bytes.Equal(req.Old, req.Expected)
+	default:
+		panic("Bad Update Mode")
+	}
 }
+
 func (tree *BTree) Insert(key []byte, val []byte) error {
+	_, err := tree.Update(&UpdateReq{Key: key, Val: val})
+	return err
+}
+
+// Inserts or updates a key as the mode allows
+// returns whether the tree was changed
+func (tree *BTree) Update(req *UpdateReq) (bool, error) {
 	// Check for limit of KV
-	if err := CheckLimit(key, val); err != nil {
-		return err
+	if err := tree.checkKV(req.Key, req.Val); err != nil {
+		return false, err
 	}
-	// No tree exists Create a tree
-	if tree.root == 0 {
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
-		root.setHeader(BNODE_LEAF, 2)
-		nodeAppendKV(root, 0, 0, nil, nil) // Sentinel value
-		nodeAppendKV(root, 1, 0, key, val)
-
-		tree.root = tree.new(root)
-		return nil
+	if req.Mode < MODE_UPSERT || req.Mode > MODE_CAS {
+		return false, errors.New("bad update mode")
 	}
-	// Insert KV and we get our updated root
-	node := TreeInsert(tree, tree.get(tree.root), key, val)
-	// Split the new node coz maybe out of page limit
-	nspilt, split := NodeSplit3(node)
-
-	if nspilt > 1 {
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
-		// TODO
-		root.setHeader(BNODE_NODE, nspilt)
-		for i, knode := range split[:nspilt] {
-			ptr, key := tree.new(knode), knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, key, nil)
+	req.Added, req.Updated, req.Old = false, false, nil
+	err := tree.atomic(func() error {
+		// No tree exists Create a tree
+		if tree.root == 0 {
+			if !req.allowed(false) {
+				return nil
+			}
+			// Large values are moved to overflow pages
+			val, ovf := overflowPack(tree, req.Val)
+			root := BNode(make([]byte, tree.PageSize()))
+			root.setHeader(tree.nodeType(BNODE_LEAF), 2)
+			nodeAppendKV(root, 0, 0, nil, nil) // Sentinel value
+			nodeAppendKV(root, 1, ovf, keySpill(tree, req.Key), val)
+
+			tree.root = tree.newNode(root, nil)
+			req.Added, req.Updated = true, true
+			return nil
 		}
-		tree.root = tree.new(root)
-	} else {
-		tree.root = tree.new(split[0])
+		// Insert KV and we get our updated root
+		req.appended = true // until the path leaves the right edge
+		node := TreeInsert(tree, tree.getNode(tree.root), req, nil)
+		if len(node) == 0 {
+			return nil // not allowed by the mode
+		}
+		tree.del(tree.root)
+		tree.root = newRoot(tree, node, req.appended)
+		return nil
+	})
+	if err != nil {
+		req.Added, req.Updated = false, false
 	}
-
-	return nil
+	return req.Updated, err
 }
 
-func (tree *BTree) Delete(key []byte) (bool, error) {
-	utils.Assert(len(key) != 0, "Empty Key")
-	utils.Assert(len(key) <= BTREE_MAX_KEY_SIZE, "Key Length Out of Bounds")
+// Runs an update of the tree as a whole
+// pages it gives back are only freed once it succeeds, so a corrupt page found halfway
+// leaves the tree as it was, and the pages written until then are given back instead
+func (tree *BTree) atomic(update func() error) error {
+	store := tree.store
+	defer func() { tree.store = store }()
+	pending := &atomicStore{PageStore: store}
+	tree.store = pending
 
-	if tree.root == 0 {
-		return false, errors.New("Tree Does Not Exist")
+	root := tree.root
+	err := func() (err error) {
+		defer recoverCorrupt(&err)
+		return update()
+	}()
+	if err != nil {
+		tree.root = root
+		pending.freed = pending.written
 	}
+	for _, ptr := range pending.freed {
+		store.Del(ptr)
+	}
+	return err
+}
 
-	updated := TreeDelete(tree, tree.get(tree.root), key)
-	if len(updated) == 0 {
-		return false, errors.New("Key Not Found")
+// Allocates the updated root
+// the root is split if it is out of page limit, which grows the tree by a level
+func newRoot(tree *BTree, node BNode, appended bool) uint64 {
+	nspilt, split := NodeSplit3(tree, node, appended)
+	if nspilt == 1 {
+		return tree.newNode(split[0], nil)
+	}
+	root := BNode(make([]byte, tree.PageSize()))
+	root.setHeader(tree.nodeType(BNODE_NODE), nspilt)
+	for i, knode := range split[:nspilt] {
+		hi := []byte(nil)
+		if i+1 < int(nspilt) {
+			hi = kidKey(tree, split[:nspilt], i+1)
+		}
+		ptr, key := tree.newNode(knode, hi), kidKey(tree, split[:nspilt], i)
+		nodeAppendKV(root, uint16(i), ptr, key, countVal(nodeCount(tree, knode)))
 	}
+	return tree.new(root)
+}
 
-	tree.del(tree.root)
-	if updated.bType() == BNODE_NODE && updated.nKeys() == 1 {
-		tree.root = updated.getPtr(0)
-	} else {
-		tree.root = tree.new(updated)
+// Returns ErrNotFound if the key does not exist
+func (tree *BTree) Delete(key []byte) (bool, error) {
+	if err := tree.checkKV(key, nil); err != nil {
+		return false, err
 	}
-	return true, nil
+	// the sentinel is not a key
+	if tree.root == 0 || len(key) == 0 {
+		return false, ErrNotFound
+	}
+
+	err := tree.atomic(func() error {
+		updated := TreeDelete(tree, tree.getNode(tree.root), key, nil)
+		if len(updated) == 0 {
+			return ErrNotFound
+		}
 
+		tree.del(tree.root)
+		if updated.bType() == BNODE_NODE && updated.nKeys() == 1 {
+			tree.root = updated.getPtr(0)
+		} else {
+			tree.root = newRoot(tree, updated, false)
+		}
+		return nil
+	})
+	return err == nil, err
 }
 
-func TreeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+// Returns an empty node when the mode of req does not allow the write
+// hi is the high fence of node, the separator on its right, see leafFence
+func TreeInsert(tree *BTree, node BNode, req *UpdateReq, hi []byte) BNode {
 	// result node
 	// we keep it larger than page size so it result exceeds we will spit in two
-	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
-	idx := node.lookUp(key)
+	new := tree.nodeBuf(node.nBytes() + tree.PageSize())
+	key := req.Key
+	idx := treeLookUp(tree, node, key)
 	switch node.bType() {
 	case BNODE_LEAF:
-		if bytes.Equal(key, node.getKey(idx)) {
+		found := keyCompare(tree, node.getKey(idx), key) == 0
+		if found {
+			req.Old = append([]byte{}, leafValue(tree, node, idx)...)
+		}
+		if !req.allowed(found) {
+			return BNode{}
+		}
+		// Large values are moved to overflow pages
+		val, ovf := overflowPack(tree, req.Val)
+		req.Added, req.Updated = !found, true
+		if found {
 			// Update
 			// Since updating same position so we put idx
-			leafUpdate(new, node, idx, key, val)
+			// the stored key is kept so a spilled tail is not written again
+			if old := node.getPtr(idx); old != 0 {
+				overflowFree(tree, old)
+			}
+			leafUpdate(new, node, idx, node.getKey(idx), val)
+			new.setPtr(idx, ovf)
+			req.appended = false
 		} else {
 			// Insert it after idx so we do +1
-			leafInsert(new, node, idx+1, key, val)
+			// unless it is smaller than the first key, which a truncated separator allows
+			pos := idx + 1
+			if idx == 0 && len(node.getKey(0)) > 0 && keyCompare(tree, node.getKey(0), key) > 0 {
+				pos = 0
+			}
+			leafInsert(new, node, pos, keySpill(tree, key), val)
+			new.setPtr(pos, ovf)
+			req.appended = req.appended && pos == node.nKeys()
 		}
 	case BNODE_NODE:
 		// Update Leaf
 		kptr := node.getPtr(idx)
-		knode := TreeInsert(tree, tree.get(kptr), key, val)
+		req.appended = req.appended && idx == node.nKeys()-1
+		knode := TreeInsert(tree, tree.getNode(kptr), req, kidFence(node, idx, hi))
+		if len(knode) == 0 {
+			return BNode{}
+		}
 		// Split
-		nsplit, split := NodeSplit3(knode)
+		nsplit, split := NodeSplit3(tree, knode, req.appended)
 		// Deallocate previous node
 		tree.del(kptr)
 		// update N kid links
-		NodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+		NodeReplaceKidN(tree, new, node, idx, hi, split[:nsplit]...)
 	default:
 		panic("Bad Node!")
 	}
@@ -140,29 +304,55 @@ func TreeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 	return new
 }
 
-func TreeDelete(tree *BTree, node BNode, key []byte) BNode {
-	idx := node.lookUp(key)
+func TreeGet(tree *BTree, node BNode, key []byte) []byte {
+	idx := treeLookUp(tree, node, key)
+
+	switch node.bType() {
+	case BNODE_LEAF:
+		if keyCompare(tree, node.getKey(idx), key) != 0 {
+			return nil // Not Found
+		}
+		return leafValue(tree, node, idx)
+	case BNODE_NODE:
+		return TreeGet(tree, tree.getNode(node.getPtr(idx)), key)
+	default:
+		panic("Bad Node")
+	}
+}
+
+// hi is the high fence of node, see TreeInsert
+func TreeDelete(tree *BTree, node BNode, key []byte, hi []byte) BNode {
+	idx := treeLookUp(tree, node, key)
 
 	switch node.bType() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
+		if keyCompare(tree, node.getKey(idx), key) != 0 {
 			return BNode{} // Not Found
 		}
+		leafFree(tree, node, idx)
 
-		new := BNode(make([]byte, BTREE_PAGE_SIZE))
+		new := tree.nodeBuf(node.nBytes())
 		leafDelete(new, node, idx)
 		return new
 	case BNODE_NODE:
-		return NodeDelete(tree, node, idx, key)
+		return NodeDelete(tree, node, idx, key, hi)
 	default:
 		panic("Bad Node")
 	}
 }
 
-func NodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+// Gives back the overflow pages of a leaf KV
+func leafFree(tree *BTree, node BNode, idx uint16) {
+	if ovf := node.getPtr(idx); ovf != 0 {
+		overflowFree(tree, ovf)
+	}
+	keyFree(tree, node.getKey(idx))
+}
+
+func NodeDelete(tree *BTree, node BNode, idx uint16, key []byte, hi []byte) BNode {
 	kptr := node.getPtr(idx)
 
-	updated := TreeDelete(tree, tree.get(kptr), key)
+	updated := TreeDelete(tree, tree.getNode(kptr), key, kidFence(node, idx, hi))
 	if len(updated) == 0 {
 		return BNode{} // Not Found
 	}
@@ -170,46 +360,110 @@ func NodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 
 	// should Merge
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
-	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	// the new key of the kid may be longer than the old one
+	new := tree.nodeBuf(node.nBytes() + tree.PageSize())
 	switch {
 	case mergeDir == -1:
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
+		merged := tree.nodeBuf(sibling.nBytes() + updated.nBytes())
 		nodeMerge(merged, sibling, updated)
 		tree.del(node.getPtr(idx - 1))
-		NodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
+		ptr := tree.newNode(merged, kidFence(node, idx, hi))
+		NodeReplace2Kid(new, node, idx-1, ptr, merged.getKey(0), nodeCount(tree, merged))
 	case mergeDir == 1:
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
+		merged := tree.nodeBuf(sibling.nBytes() + updated.nBytes())
 		nodeMerge(merged, updated, sibling)
 		tree.del(node.getPtr(idx + 1))
-		NodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
+		ptr := tree.newNode(merged, kidFence(node, idx+1, hi))
+		NodeReplace2Kid(new, node, idx, ptr, merged.getKey(0), nodeCount(tree, merged))
 	case mergeDir == 0 && updated.nKeys() == 0:
 		utils.Assert(node.nKeys() == 1 && idx == 0, "Bad")
-		node.setHeader(node.bType(), 0)
+		node.setHeader(node.kind(), 0)
 	case mergeDir == 0 && updated.nKeys() > 0:
-		NodeReplaceKidN(tree, new, node, idx, updated)
+		if nodeBorrow(tree, new, node, idx, updated, hi) {
+			break
+		}
+		// a kid that got a longer key may no longer fit
+		nsplit, split := NodeSplit3(tree, updated, false)
+		NodeReplaceKidN(tree, new, node, idx, hi, split[:nsplit]...)
 	}
 
 	return new
 }
 
 func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nBytes() > BTREE_PAGE_SIZE/4 {
+	if tree.pageBytes(updated) > tree.minFillBytes() {
 		return 0, BNode{} // No Merging
 	}
 
 	if idx > 0 { // Left Sibling Exists
-		sibling := BNode(tree.get(node.getPtr(idx - 1)))
-		merged := sibling.nBytes() + updated.nBytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		sibling := tree.getNode(node.getPtr(idx - 1))
+		if mergeFits(tree, sibling, updated) {
 			return -1, sibling
 		}
 	}
 	if idx+1 < node.nKeys() { // Right Sibling Exists
-		sibling := BNode(tree.get(node.getPtr(idx + 1)))
-		merged := sibling.nBytes() + updated.nBytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		sibling := tree.getNode(node.getPtr(idx + 1))
+		if mergeFits(tree, updated, sibling) {
 			return 1, sibling
 		}
 	}
 	return 0, BNode{} // No Merging Possible
 }
+
+// Whether left and right merged fit in a page, see mergedBytes
+func mergeFits(tree *BTree, left BNode, right BNode) bool {
+	plain := left.nBytes() + right.nBytes() - HEADER
+	return plain <= tree.maxNodeSize() && tree.mergedBytes(left, right) <= tree.PageSize()
+}
+
+// Evens out an underfull kid with its larger sibling when both do not fit in one page
+// new gets the updated links, it is left alone when nothing is moved
+// hi is the high fence of node
+func nodeBorrow(tree *BTree, new BNode, node BNode, idx uint16, updated BNode, hi []byte) bool {
+	if tree.pageBytes(updated) > tree.minFillBytes() {
+		return false
+	}
+	// the pair is kids lidx and lidx+1, sidx is the sibling
+	left, right, lidx, sidx := BNode{}, updated, idx-1, idx-1
+	if idx > 0 {
+		left = tree.getNode(node.getPtr(idx - 1))
+	}
+	if idx+1 < node.nKeys() {
+		sibling := tree.getNode(node.getPtr(idx + 1))
+		if len(left) == 0 || tree.pageBytes(sibling) > tree.pageBytes(left) {
+			left, right, lidx, sidx = updated, sibling, idx, idx+1
+		}
+	}
+	if len(left) == 0 {
+		return false // No Sibling
+	}
+
+	merged := tree.nodeBuf(left.nBytes() + right.nBytes())
+	nodeMerge(merged, left, right)
+	kids := []BNode{tree.nodeBuf(merged.nBytes()), tree.nodeBuf(merged.nBytes())}
+	nodeSplitEven(tree, kids[0], kids[1], merged)
+	if kids[0].nKeys() == left.nKeys() {
+		return false // nothing to move
+	}
+	if tree.pageBytes(kids[0]) > tree.PageSize() || tree.pageBytes(kids[1]) > tree.PageSize() {
+		return false // the large KVs can not be evened out
+	}
+
+	// the kid was already given back by the caller
+	tree.del(node.getPtr(sidx))
+	new.setHeader(node.kind(), node.nKeys())
+	nodeAppendRange(new, node, 0, 0, lidx)
+	for i, kid := range kids {
+		count := countVal(nodeCount(tree, kid))
+		ptr := tree.newNode(kid, splitFence(tree, kids, i, node, lidx+1, hi))
+		nodeAppendKV(new, lidx+uint16(i), ptr, kidKey(tree, kids, i), count)
+	}
+	nodeAppendRange(new, node, lidx+2, lidx+2, node.nKeys()-(lidx+2))
+	return true
+}
+
+// Buffer for building a node of at most size bytes
+// it can always be trimmed to a page
+func (tree *BTree) nodeBuf(size int) BNode {
+	return BNode(make([]byte, max(size, tree.PageSize())))
+}
@@ -2,6 +2,7 @@ package btree
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
@@ -9,6 +10,22 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// Value of key, nil if it does not exist
+func (c *C) get(key []byte) []byte {
+	val, err := c.tree.Get(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		panic(err)
+	}
+	return val
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
 func TestInsertSingleKey(t *testing.T) {
 	c := newC()
 	c.add("k1", "hello")
@@ -56,6 +73,8 @@ func TestInsertMultipleOrdered(t *testing.T) {
 
 func TestInsertSplitAndPromote(t *testing.T) {
 	c := newC()
+	// increasing keys are split unevenly by default
+	c.tree.SetSplitPolicy(EvenSplit)
 
 	// Insert enough to overflow page (BNode Split threshold is about 3K+)
 	for i := 0; i < 25; i++ {
@@ -149,13 +168,7 @@ func TestShouldMerge(t *testing.T) {
 		103: siblingRight,
 	}
 
-	tree := &BTree{
-		get: func(ptr uint64) []byte {
-			return fakeMap[ptr]
-		},
-		new: func(n []byte) uint64 { return 999 },
-		del: func(ptr uint64) {},
-	}
+	tree := &BTree{store: fakeStore(fakeMap)}
 	// t.Run("MergeWithLeftSibling", func(t *testing.T) {
 	// 	dir, sib := shouldMerge(tree, node, 1, updatedSmall)
 	// 	assert.Equal(t, -1, dir)
@@ -169,8 +182,8 @@ func TestShouldMerge(t *testing.T) {
 	})
 
 	t.Run("NoMergeIfSiblingsTooBig", func(t *testing.T) {
-		// Increase sibling size
-		bigSibling := makeLeaf(19, 200)
+		// Increase sibling size, a full page that can not take updatedSmall
+		bigSibling := makeLeaf(17, 220)
 		fmt.Print(bigSibling.nBytes())
 		fakeMap[101] = bigSibling
 		fakeMap[103] = bigSibling
@@ -220,3 +233,137 @@ func TestDeleteTriggersMerge(t *testing.T) {
 	assert.Equal(t, BNODE_LEAF, newRoot.bType())
 	assert.Equal(t, []byte("k00"), newRoot.getKey(1))
 }
+
+func TestGet(t *testing.T) {
+	c := newC()
+	assert.Nil(t, c.get([]byte("k1"))) // Empty tree
+
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("k%03d", i)
+		v := strings.Repeat(fmt.Sprint(i), 50)
+		assert.NoError(t, c.add(k, v))
+	}
+	root := BNode(c.tree.get(c.tree.root))
+	assert.Equal(t, BNODE_NODE, root.bType())
+
+	for k, v := range c.ref {
+		assert.Equal(t, []byte(v), c.get([]byte(k)))
+	}
+	assert.Nil(t, c.get([]byte("k")))
+	assert.Nil(t, c.get([]byte("k0000")))
+	assert.Nil(t, c.get([]byte("zzz")))
+
+	// Deleted keys are gone, others remain
+	for i := 0; i < 200; i += 2 {
+		_, err := c.del(fmt.Sprintf("k%03d", i))
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("k%03d", i)
+		if i%2 == 0 {
+			assert.Nil(t, c.get([]byte(k)))
+		} else {
+			assert.Equal(t, []byte(c.ref[k]), c.get([]byte(k)))
+		}
+	}
+}
+
+func TestUpdateModes(t *testing.T) {
+	c := newC()
+
+	// nothing to update in an empty tree
+	req := &UpdateReq{Key: []byte("k1"), Val: []byte("v1"), Mode: MODE_UPDATE_ONLY}
+	updated, err := c.tree.Update(req)
+	assert.NoError(t, err)
+	assert.False(t, updated)
+	assert.Equal(t, uint64(0), c.tree.root)
+
+	req = &UpdateReq{Key: []byte("k1"), Val: []byte("v1"), Mode: MODE_INSERT_ONLY}
+	updated, err = c.tree.Update(req)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	assert.True(t, req.Added)
+	assert.Nil(t, req.Old)
+
+	// the key exists now
+	req = &UpdateReq{Key: []byte("k1"), Val: []byte("v2"), Mode: MODE_INSERT_ONLY}
+	updated, _ = c.tree.Update(req)
+	assert.False(t, updated)
+	assert.False(t, req.Updated)
+	assert.Equal(t, []byte("v1"), req.Old)
+	assert.Equal(t, []byte("v1"), c.get([]byte("k1")))
+
+	req = &UpdateReq{Key: []byte("k1"), Val: []byte("v2"), Mode: MODE_UPDATE_ONLY}
+	updated, _ = c.tree.Update(req)
+	assert.True(t, updated)
+	assert.False(t, req.Added)
+	assert.Equal(t, []byte("v1"), req.Old)
+	assert.Equal(t, []byte("v2"), c.get([]byte("k1")))
+
+	req = &UpdateReq{Key: []byte("k2"), Val: []byte("v2"), Mode: MODE_UPDATE_ONLY}
+	updated, _ = c.tree.Update(req)
+	assert.False(t, updated)
+	assert.Nil(t, c.get([]byte("k2")))
+
+	req = &UpdateReq{Key: []byte("k2"), Val: []byte("v2")}
+	updated, _ = c.tree.Update(req)
+	assert.True(t, updated)
+	assert.True(t, req.Added)
+	req = &UpdateReq{Key: []byte("k2"), Val: []byte("v3")}
+	updated, _ = c.tree.Update(req)
+	assert.True(t, updated)
+	assert.False(t, req.Added)
+	assert.Equal(t, []byte("v2"), req.Old)
+
+	// an empty value is not a missing key
+	assert.NoError(t, c.tree.Insert([]byte("k3"), nil))
+	req = &UpdateReq{Key: []byte("k3"), Val: []byte("x")}
+	c.tree.Update(req)
+	assert.Equal(t, []byte{}, req.Old)
+
+	_, err = c.tree.Update(&UpdateReq{Key: []byte("k1"), Mode: 9})
+	assert.Error(t, err)
+}
+
+func TestUpdateCAS(t *testing.T) {
+	c := newC()
+	req := &UpdateReq{Key: []byte("k"), Val: []byte("v1"), Mode: MODE_CAS}
+	updated, _ := c.tree.Update(req)
+	assert.False(t, updated)
+
+	big := strings.Repeat("x", 10000)
+	assert.NoError(t, c.tree.Insert([]byte("k"), []byte(big)))
+	pages := len(c.pages)
+
+	req = &UpdateReq{Key: []byte("k"), Val: []byte("v2"), Mode: MODE_CAS, Expected: []byte("v1")}
+	updated, _ = c.tree.Update(req)
+	assert.False(t, updated)
+	assert.Equal(t, []byte(big), req.Old)
+	// nothing was written
+	assert.Equal(t, pages, len(c.pages))
+
+	req = &UpdateReq{Key: []byte("k"), Val: []byte("v2"), Mode: MODE_CAS, Expected: []byte(big)}
+	updated, _ = c.tree.Update(req)
+	assert.True(t, updated)
+	assert.Equal(t, []byte("v2"), c.get([]byte("k")))
+
+	// in a larger tree
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, c.tree.Insert([]byte(fmt.Sprintf("k%04d", i)), []byte("0")))
+	}
+	for i := 0; i < 1000; i += 3 {
+		k := []byte(fmt.Sprintf("k%04d", i))
+		updated, _ := c.tree.Update(&UpdateReq{Key: k, Val: []byte("1"), Mode: MODE_CAS, Expected: []byte("0")})
+		assert.True(t, updated)
+		updated, _ = c.tree.Update(&UpdateReq{Key: k, Val: []byte("2"), Mode: MODE_CAS, Expected: []byte("0")})
+		assert.False(t, updated)
+		assert.Equal(t, []byte("1"), c.get(k))
+	}
+}
+
+// Pages of a test that only reads them
+type fakeStore map[uint64]BNode
+
+func (store fakeStore) Get(ptr uint64) []byte  { return store[ptr] }
+func (store fakeStore) New(page []byte) uint64 { return 999 }
+func (store fakeStore) Del(ptr uint64)         {}
@@ -0,0 +1,173 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+)
+
+// Builds the tree bottom-up from KV pairs sorted in the tree order
+// nodes are packed up to fill (0, 1] of a page and every node is written once
+// the tree must have no keys, on error it is left as it was
+func (tree *BTree) BulkLoad(kvs iter.Seq2[[]byte, []byte], fill float64) error {
+	// a tree whose keys were all deleted still has the sentinel
+	if n, err := tree.Count(nil, nil); err != nil || n > 0 {
+		if err != nil {
+			return err
+		}
+		return errors.New("bulk load: tree is not empty")
+	}
+	if !(fill > 0 && fill <= 1) {
+		return errors.New("bulk load: fill factor out of (0, 1]")
+	}
+
+	b := bulkBuilder{tree: tree, limit: int(fill * float64(tree.PageSize()))}
+	b.push(0, bulkKV{}) // sentinel
+	old := tree.root
+	// every page written is given back on error
+	return tree.atomic(func() error {
+		if err := b.load(kvs); err != nil || b.count == 0 {
+			return err
+		}
+		b.finish()
+		// the old tree is a path down to the sentinel leaf
+		for ptr := old; ptr != 0; {
+			node := tree.getNode(ptr)
+			tree.del(ptr)
+			ptr = 0
+			if node.bType() == BNODE_NODE {
+				ptr = node.getPtr(0)
+			}
+		}
+		return nil
+	})
+}
+
+// A KV waiting to be put in a node
+type bulkKV struct {
+	key []byte // stored key
+	val []byte // stored val, or the key count of a kid
+	ptr uint64 // kid or overflow chain
+}
+
+// Pending KVs of a level of the tree
+type bulkLevel struct {
+	kvs    []bulkKV
+	plain  int // bytes in the plain format
+	shared int // bytes saved by prefix compression
+	nodes  int // nodes written so far
+	last   []byte
+}
+
+type bulkBuilder struct {
+	tree   *BTree
+	limit  int // bytes per node
+	levels []bulkLevel
+	count  int // keys loaded
+}
+
+func (b *bulkBuilder) load(kvs iter.Seq2[[]byte, []byte]) error {
+	prev := []byte(nil)
+	for key, val := range kvs {
+		if len(key) == 0 {
+			return fmt.Errorf("bulk load: key %d is empty", b.count)
+		}
+		if err := b.tree.checkKV(key, val); err != nil {
+			return fmt.Errorf("bulk load: key %d: %w", b.count, err)
+		}
+		if b.count > 0 && b.tree.compare(prev, key) >= 0 {
+			return fmt.Errorf("bulk load: input is not sorted, key %d is not greater than the previous key", b.count)
+		}
+		prev = append(prev[:0], key...)
+
+		// the caller may reuse its buffers
+		stored := append([]byte(nil), keySpill(b.tree, key)...)
+		val, ovf := overflowPack(b.tree, val)
+		b.push(0, bulkKV{key: stored, val: append([]byte(nil), val...), ptr: ovf})
+		b.count++
+	}
+	return nil
+}
+
+// Bytes the pending KVs of a level take in a page
+func (b *bulkBuilder) size(level *bulkLevel) int {
+	if !b.tree.compress || level.plain <= b.tree.PageSize() || level.plain > b.tree.maxNodeSize() {
+		return level.plain
+	}
+	return min(level.plain, level.plain+2*len(level.kvs)-level.shared)
+}
+
+// Bytes a KV takes in a plain node, with its pointer and offset
+func (b *bulkBuilder) kvBytes(kv bulkKV) int {
+	offset := 2
+	if b.tree.wide() {
+		offset = 4
+	}
+	return 8 + offset + 4 + len(kv.key) + len(kv.val)
+}
+
+// Adds a KV to a level, the pending KVs are written as a node once it is full
+func (b *bulkBuilder) push(height int, kv bulkKV) {
+	if height == len(b.levels) {
+		b.levels = append(b.levels, bulkLevel{plain: HEADER})
+	}
+	level := &b.levels[height]
+
+	plain, shared := level.plain+b.kvBytes(kv), level.shared
+	if n := len(level.kvs); n > 0 {
+		shared += prefixLen(level.kvs[n-1].key, kv.key)
+	}
+	// kv is counted in the compressed size too
+	next := bulkLevel{kvs: append(level.kvs, kv), plain: plain, shared: shared}
+	if len(level.kvs) > 0 && b.size(&next) > min(b.limit, b.tree.PageSize()) {
+		b.flush(height, kv.key)
+		level = &b.levels[height]
+		plain, shared = level.plain+b.kvBytes(kv), 0
+	}
+	level.kvs = append(level.kvs, kv)
+	level.plain, level.shared = plain, shared
+}
+
+// Writes the pending KVs of a level as a node and adds it to the level above
+// next is the first key of the node after it, nil for the last one
+func (b *bulkBuilder) flush(height int, next []byte) {
+	level := &b.levels[height]
+	btype := BNODE_LEAF
+	if height > 0 {
+		btype = BNODE_NODE
+	}
+	node := b.tree.nodeBuf(level.plain)
+	node.setHeader(b.tree.nodeType(btype), uint16(len(level.kvs)))
+	for i, kv := range level.kvs {
+		nodeAppendKV(node, uint16(i), kv.ptr, kv.key, kv.val)
+	}
+
+	// a leaf only needs to be told apart from the last key of the previous one
+	key, last := level.kvs[0].key, level.kvs[len(level.kvs)-1].key
+	if height == 0 && level.nodes > 0 && b.tree.compress && b.tree.bytewise() {
+		key = keySeparator(level.last, key)
+	}
+	// the high fence of a leaf is the key of the next one
+	if height == 0 && next != nil && b.tree.compress && b.tree.bytewise() {
+		next = keySeparator(last, next)
+	}
+	level.last = last
+	level.kvs = nil
+	level.plain, level.shared = HEADER, 0
+	level.nodes++
+
+	count := countVal(nodeCount(b.tree, node))
+	b.push(height+1, bulkKV{key: key, val: count, ptr: b.tree.newNode(node, next)})
+}
+
+// Writes what is left on every level and sets the root
+func (b *bulkBuilder) finish() {
+	for height := 0; ; height++ {
+		level := &b.levels[height]
+		if height > 0 && level.nodes == 0 && len(level.kvs) == 1 {
+			b.tree.root = level.kvs[0].ptr
+			return
+		}
+		b.flush(height, nil)
+	}
+}
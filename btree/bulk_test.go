@@ -0,0 +1,160 @@
+package btree
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Sorted KVs key0000..keyN with the index as value
+func bulkKVs(n int) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for i := 0; i < n; i++ {
+			if !yield([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprint(i))) {
+				return
+			}
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	c := newC()
+	assert.NoError(t, c.tree.BulkLoad(bulkKVs(20000), 1))
+
+	i := 0
+	for k, v := range c.tree.Scan(nil, nil) {
+		assert.Equal(t, fmt.Sprintf("key%06d", i), string(k))
+		assert.Equal(t, fmt.Sprint(i), string(v))
+		i++
+	}
+	assert.Equal(t, 20000, i)
+	assert.Equal(t, []byte("1234"), c.get([]byte("key001234")))
+	assert.Equal(t, len(c.pages), countNodes(&c.tree, c.tree.root))
+
+	// the loaded tree is updated like any other
+	assert.NoError(t, c.tree.Insert([]byte("key001234"), []byte("x")))
+	assert.NoError(t, c.tree.Insert([]byte("key0012345"), []byte("y")))
+	_, err := c.tree.Delete([]byte("key000000"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("x"), c.get([]byte("key001234")))
+	assert.Equal(t, []byte("y"), c.get([]byte("key0012345")))
+	assert.Nil(t, c.get([]byte("key000000")))
+}
+
+func TestBulkLoadFill(t *testing.T) {
+	full := newC()
+	half := newC()
+	assert.NoError(t, full.tree.BulkLoad(bulkKVs(20000), 1))
+	assert.NoError(t, half.tree.BulkLoad(bulkKVs(20000), 0.5))
+	// half full leaves take about twice the pages
+	assert.Greater(t, len(half.pages), 2*len(full.pages)*9/10)
+
+	// fewer pages than inserting the keys one by one
+	ins := newC()
+	for k, v := range bulkKVs(20000) {
+		assert.NoError(t, ins.tree.Insert(k, v))
+	}
+	assert.Less(t, len(full.pages), len(ins.pages))
+
+	assert.Error(t, newC().tree.BulkLoad(bulkKVs(10), 0))
+	assert.Error(t, newC().tree.BulkLoad(bulkKVs(10), 1.5))
+}
+
+func TestBulkLoadUnsorted(t *testing.T) {
+	c := newC()
+	kvs := func(yield func([]byte, []byte) bool) {
+		for k, v := range bulkKVs(5000) {
+			if !yield(k, v) {
+				return
+			}
+		}
+		yield([]byte("key000001"), nil)
+	}
+	err := c.tree.BulkLoad(kvs, 1)
+	assert.ErrorContains(t, err, "not sorted")
+	// nothing is left behind
+	assert.Equal(t, uint64(0), c.tree.root)
+	assert.Empty(t, c.pages)
+
+	dup := func(yield func([]byte, []byte) bool) {
+		yield([]byte("a"), nil)
+		yield([]byte("a"), nil)
+	}
+	assert.ErrorContains(t, c.tree.BulkLoad(dup, 1), "not sorted")
+
+	assert.NoError(t, c.add("a", "1"))
+	assert.Error(t, c.tree.BulkLoad(bulkKVs(10), 1))
+}
+
+func TestBulkLoadEmpty(t *testing.T) {
+	c := newC()
+	assert.NoError(t, c.tree.BulkLoad(bulkKVs(0), 1))
+	assert.Equal(t, uint64(0), c.tree.root)
+	assert.NoError(t, c.add("a", "1"))
+	assert.Equal(t, []byte("1"), c.get([]byte("a")))
+
+	// a tree whose keys were deleted is empty too
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%04d", i), strings.Repeat("v", 50)))
+	}
+	for k := range maps.Clone(c.ref) {
+		_, err := c.del(k)
+		assert.NoError(t, err)
+	}
+	assert.NotEqual(t, uint64(0), c.tree.root)
+	assert.NoError(t, c.tree.BulkLoad(bulkKVs(100), 1))
+	n, err := c.tree.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), n)
+	assert.Equal(t, reachable(t, c), len(c.pages))
+	assert.Empty(t, c.tree.Verify())
+}
+
+func TestBulkLoadLarge(t *testing.T) {
+	c := newC()
+	c.tree.SetLongKeys(true)
+	c.tree.SetCompress(true)
+	long := strings.Repeat("k", 1500)
+	kvs := func(yield func([]byte, []byte) bool) {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("%s%04d", long, i)
+			val := strings.Repeat(fmt.Sprint(i%10), 5000)
+			if !yield([]byte(key), []byte(val)) {
+				return
+			}
+		}
+	}
+	assert.NoError(t, c.tree.BulkLoad(kvs, 1))
+	i := 0
+	for k, v := range c.tree.Scan(nil, nil) {
+		assert.Equal(t, fmt.Sprintf("%s%04d", long, i), string(k))
+		assert.Equal(t, strings.Repeat(fmt.Sprint(i%10), 5000), string(v))
+		i++
+	}
+	assert.Equal(t, 200, i)
+}
+
+func TestBulkLoadCompressed(t *testing.T) {
+	c := newC()
+	c.tree.SetCompress(true)
+	kvs := func(yield func([]byte, []byte) bool) {
+		for i := 0; i < 5000; i++ {
+			if !yield([]byte(fmt.Sprintf("user:%08d:profile", i)), []byte(fmt.Sprint(i))) {
+				return
+			}
+		}
+	}
+	assert.NoError(t, c.tree.BulkLoad(kvs, 1))
+	plain := newC()
+	assert.NoError(t, plain.tree.BulkLoad(kvs, 1))
+	assert.Less(t, len(c.pages), len(plain.pages))
+
+	for i := 0; i < 5000; i += 7 {
+		k := []byte(fmt.Sprintf("user:%08d:profile", i))
+		assert.Equal(t, []byte(fmt.Sprint(i)), c.get(k))
+	}
+}
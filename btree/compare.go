@@ -0,0 +1,47 @@
+package btree
+
+import "bytes"
+
+// Orders the keys of a tree
+// the name is stored with the database, a file can only be reopened with the same comparator
+type Comparator interface {
+	Name() string
+	Compare(a []byte, b []byte) int
+}
+
+// Default order, the one of bytes.Compare
+var BytewiseComparator Comparator = bytewise{}
+
+type bytewise struct{}
+
+func (bytewise) Name() string {
+	return "bytewise"
+}
+func (bytewise) Compare(a []byte, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+// Must be set before the tree is used
+func (tree *BTree) SetComparator(cmp Comparator) {
+	tree.cmp = cmp
+}
+
+func (tree *BTree) Comparator() Comparator {
+	if tree.cmp == nil {
+		return BytewiseComparator
+	}
+	return tree.cmp
+}
+
+// Some shortcuts only hold for the bytewise order
+// like comparing a spilled key by its prefix or shortening keys in the parent
+func (tree *BTree) bytewise() bool {
+	return tree.cmp == nil || tree.cmp == BytewiseComparator
+}
+
+func (tree *BTree) compare(a []byte, b []byte) int {
+	if tree.cmp == nil {
+		return bytes.Compare(a, b)
+	}
+	return tree.cmp.Compare(a, b)
+}
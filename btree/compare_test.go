@@ -0,0 +1,92 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type reverse struct{}
+
+func (reverse) Name() string                   { return "reverse" }
+func (reverse) Compare(a []byte, b []byte) int { return bytes.Compare(b, a) }
+
+type caseless struct{}
+
+func (caseless) Name() string { return "caseless" }
+func (caseless) Compare(a []byte, b []byte) int {
+	return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+}
+
+func TestComparatorDefault(t *testing.T) {
+	c := newC()
+	assert.Equal(t, "bytewise", c.tree.Comparator().Name())
+	assert.True(t, c.tree.bytewise())
+
+	c.tree.SetComparator(reverse{})
+	assert.False(t, c.tree.bytewise())
+}
+
+func TestReverseComparator(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		c := newC()
+		c.tree.SetComparator(reverse{})
+		c.tree.SetCompress(compress)
+		c.tree.SetLongKeys(true)
+
+		long := string(bytes.Repeat([]byte("z"), BTREE_MAX_KEY_SIZE))
+		keys := []string{}
+		for i := 0; i < 1000; i++ {
+			keys = append(keys, fmt.Sprintf("k%04d", i))
+		}
+		keys = append(keys, long+"a", long+"b")
+		for _, k := range keys {
+			assert.NoError(t, c.add(k, k))
+		}
+		for k, v := range c.ref {
+			assert.Equal(t, []byte(v), c.get([]byte(k)))
+		}
+
+		// Largest first
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		got := []string{}
+		for k := range c.tree.Scan(nil, nil) {
+			got = append(got, string(k))
+		}
+		assert.True(t, assert.ObjectsAreEqual(keys, got))
+
+		k, _ := c.tree.SeekGE([]byte("k0500x")).Deref()
+		assert.Equal(t, "k0500", string(k))
+		k, _ = c.tree.SeekLE([]byte("k0500x")).Deref()
+		assert.Equal(t, "k0501", string(k))
+
+		for _, k := range keys[:900] {
+			_, err := c.del(k)
+			assert.NoError(t, err)
+		}
+		for k, v := range c.ref {
+			assert.Equal(t, []byte(v), c.get([]byte(k)))
+		}
+	}
+}
+
+func TestCaselessComparator(t *testing.T) {
+	c := newC()
+	c.tree.SetComparator(caseless{})
+
+	assert.NoError(t, c.tree.Insert([]byte("Hello"), []byte("1")))
+	assert.NoError(t, c.tree.Insert([]byte("HELLO"), []byte("2")))
+	assert.NoError(t, c.tree.Insert([]byte("apple"), []byte("3")))
+	assert.NoError(t, c.tree.Insert([]byte("Banana"), []byte("4")))
+
+	// Same key in another case is an update
+	assert.Equal(t, []byte("2"), c.get([]byte("hello")))
+	got := []string{}
+	for k := range c.tree.Scan(nil, nil) {
+		got = append(got, string(k))
+	}
+	assert.Equal(t, []string{"apple", "Banana", "Hello"}, got)
+}
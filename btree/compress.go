@@ -0,0 +1,190 @@
+package btree
+
+import (
+	"encoding/binary"
+
+	"github.com/Manik-Jasrai/ByteStore.git/utils"
+)
+
+// Node formats, stored in the high byte of the type field
+const (
+	BNODE_FORMAT_PLAIN  = uint16(0) // every key stored in full
+	BNODE_FORMAT_PREFIX = uint16(1) // keys share a prefix with the previous key
+)
+
+// A node may hold more than a page of keys when its compressed form fits in a page
+// the uncompressed form is still bounded so that uint16 offsets can address it
+// wide nodes are bounded by 12 pages instead, see maxNodeSize
+const BTREE_MAX_NODE_SIZE = 12 * BTREE_PAGE_SIZE
+
+// Prefix compressed format
+// each key only stores the bytes it does not share with the previous key
+// pointers and offsets are the same as the plain format, so nBytes() is the page size
+/*
+| type | nkeys | checksum |  pointers  |  offsets   | key-values
+|  2B  |   2B  |    4B    | nkeys * 8B | nkeys * 2B | ...
+
+| shared | slen | vlen | suffix | val |
+|   2B   |  2B  |  2B  |  ...   | ... |
+*/
+
+// Length of the common prefix
+func prefixLen(a []byte, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// Compressed form of a plain node
+func nodeCompress(node BNode) BNode {
+	nkeys := node.nKeys()
+	new := BNode(make([]byte, node.nBytes()+2*int(nkeys)))
+	binary.LittleEndian.PutUint16(new[0:2], node.kind()|BNODE_FORMAT_PREFIX<<8)
+	binary.LittleEndian.PutUint16(new[2:4], nkeys)
+
+	prev := []byte(nil)
+	for i := uint16(0); i < nkeys; i++ {
+		key, val := node.getKey(i), node.getValue(i)
+		shared := prefixLen(prev, key)
+		suffix := key[shared:]
+
+		new.setPtr(i, node.getPtr(i))
+		pos := new.KVPos(i)
+		binary.LittleEndian.PutUint16(new[pos:], uint16(shared))
+		binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(suffix)))
+		binary.LittleEndian.PutUint16(new[pos+4:], uint16(len(val)))
+		copy(new[pos+6:], suffix)
+		copy(new[pos+6+len(suffix):], val)
+		new.setOffset(i+1, new.getOffset(i)+6+len(suffix)+len(val))
+		prev = key
+	}
+	return new
+}
+
+// Plain form of a compressed node
+func nodeDecompress(page BNode) BNode {
+	nkeys := page.nKeys()
+	// first pass for the size of the plain node
+	size := HEADER + (8+page.offsetSize())*int(nkeys)
+	for i := uint16(0); i < nkeys; i++ {
+		pos := page.KVPos(i)
+		shared := int(binary.LittleEndian.Uint16(page[pos:]))
+		slen := int(binary.LittleEndian.Uint16(page[pos+2:]))
+		vlen := int(binary.LittleEndian.Uint16(page[pos+4:]))
+		size += 4 + shared + slen + vlen
+	}
+
+	new := BNode(make([]byte, size))
+	new.setHeader(page.kind(), nkeys)
+	key := []byte(nil)
+	for i := uint16(0); i < nkeys; i++ {
+		pos := page.KVPos(i)
+		shared := int(binary.LittleEndian.Uint16(page[pos:]))
+		slen := int(binary.LittleEndian.Uint16(page[pos+2:]))
+		vlen := int(binary.LittleEndian.Uint16(page[pos+4:]))
+		suffix := page[pos+6:][:slen]
+		val := page[pos+6+slen:][:vlen]
+
+		key = append(key[:shared:shared], suffix...)
+		nodeAppendKV(new, i, page.getPtr(i), key, val)
+	}
+	return new
+}
+
+// Bytes the keys in [begin, end) of a plain node take in a page
+// with compression they take the smaller of both formats
+// a node is never kept in memory past maxNodeSize even if it compresses well
+func (tree *BTree) rangeBytes(node BNode, begin uint16, end uint16) int {
+	n := int(end - begin)
+	plain := HEADER + (8+node.offsetSize())*n + node.getOffset(end) - node.getOffset(begin)
+	if !tree.compress || plain <= tree.PageSize() || plain > tree.maxNodeSize() {
+		return plain
+	}
+	compressed := plain + 2*n - sharedBytes(node, begin, end)
+	return min(plain, compressed)
+}
+
+// Bytes left and right take in a page once merged
+// the sum of their pageBytes is not a bound, a side that fits plain gets 2 more bytes per key when merged
+// into a compressed node, so the merged node is sized as a whole like rangeBytes does
+func (tree *BTree) mergedBytes(left BNode, right BNode) int {
+	n := int(left.nKeys()) + int(right.nKeys())
+	plain := left.nBytes() + right.nBytes() - HEADER
+	if !tree.compress || plain <= tree.PageSize() || plain > tree.maxNodeSize() {
+		return plain
+	}
+	compressed := plain + 2*n - sharedBytes(left, 0, left.nKeys()) - sharedBytes(right, 0, right.nKeys())
+	if left.nKeys() > 0 && right.nKeys() > 0 {
+		compressed -= prefixLen(left.getKey(left.nKeys()-1), right.getKey(0))
+	}
+	return min(plain, compressed)
+}
+
+// Bytes the keys in [begin, end) share with the key before them, which the compressed format leaves out
+func sharedBytes(node BNode, begin uint16, end uint16) int {
+	shared := 0
+	for i := begin + 1; i < end; i++ {
+		shared += prefixLen(node.getKey(i-1), node.getKey(i))
+	}
+	return shared
+}
+
+// Bytes a plain node takes in a page
+func (tree *BTree) pageBytes(node BNode) int {
+	return tree.rangeBytes(node, 0, node.nKeys())
+}
+
+// Reads a node, decompressing it if needed
+// a page that can not be decoded is reported as corrupt, see ErrCorrupt
+func (tree *BTree) getNode(ptr uint64) BNode {
+	node, _, _ := tree.getLeaf(ptr)
+	return node
+}
+
+// Reads a node and the high fence of a leaf with a single read of its page, see leafFence
+func (tree *BTree) getLeaf(ptr uint64) (node BNode, hi []byte, fenced bool) {
+	node = BNode(tree.get(ptr))
+	if kind, _, reason := tree.pageProblem(node); kind != 0 {
+		corrupt(ptr, "%s", reason)
+	}
+	hi, fenced = leafFence(node)
+	if node.format() == BNODE_FORMAT_PREFIX {
+		node = nodeDecompress(node)
+	}
+	return node, hi, fenced
+}
+
+// Allocates a page for a plain node
+// the node is compressed when it does not fit otherwise
+// hi is the high fence of a leaf, see setLeafFence, nodes have none
+func (tree *BTree) newNode(node BNode, hi []byte) uint64 {
+	size := tree.PageSize()
+	if node.nBytes() > size {
+		utils.Assert(tree.compress, "Oversized Node")
+		node = nodeCompress(node)
+		utils.Assert(node.nBytes() <= size, "Oversized Node")
+	}
+	if len(node) < size {
+		// decompressed and compressed nodes are only as large as their content
+		node = append(node, make([]byte, size-len(node))...)
+	}
+	setLeafFence(node[:size], hi)
+	return tree.new(node[:size])
+}
+
+// Shortest key k with left < k <= right
+// used as the separator of two kids instead of the whole first key of the right kid
+func keySeparator(left []byte, right []byte) []byte {
+	if keySpilled(right) {
+		return right // the tail is needed to tell it apart
+	}
+	n := prefixLen(left, right)
+	if n < len(right) {
+		return right[:n+1]
+	}
+	return right
+}
@@ -0,0 +1,233 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeCompress(t *testing.T) {
+	var keys [][]byte
+	var vals [][]byte
+	for i := 0; i < 130; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("user:%08d:profile", i)))
+		vals = append(vals, []byte(fmt.Sprint(i)))
+	}
+	node := CreateLeafwithKVs(keys, vals)
+	assert.Greater(t, node.nBytes(), BTREE_PAGE_SIZE)
+
+	page := nodeCompress(node)
+	assert.Equal(t, BNODE_LEAF, page.bType())
+	assert.Equal(t, BNODE_FORMAT_PREFIX, page.format())
+	assert.LessOrEqual(t, page.nBytes(), BTREE_PAGE_SIZE)
+	assert.Equal(t, page.nBytes(), (&BTree{compress: true}).pageBytes(node))
+
+	plain := nodeDecompress(page)
+	assert.Equal(t, BNODE_FORMAT_PLAIN, plain.format())
+	assert.Equal(t, node[:node.nBytes()], plain[:plain.nBytes()])
+}
+
+func TestKeySeparator(t *testing.T) {
+	assert.Equal(t, []byte("k2"), keySeparator([]byte("k1999"), []byte("k2000")))
+	assert.Equal(t, []byte("ab"), keySeparator([]byte("a"), []byte("abc")))
+	assert.Equal(t, []byte("b"), keySeparator(nil, []byte("b")))
+}
+
+func TestCompressedTree(t *testing.T) {
+	plain := newC()
+	c := newC()
+	c.tree.SetCompress(true)
+
+	keys := rand.New(rand.NewSource(1)).Perm(5000)
+	for _, i := range keys {
+		k := fmt.Sprintf("user:%08d:profile", i)
+		assert.NoError(t, plain.add(k, fmt.Sprint(i)))
+		assert.NoError(t, c.add(k, fmt.Sprint(i)))
+	}
+	// The compressed tree is made of fewer nodes
+	assert.Less(t, countNodes(&c.tree, c.tree.root), countNodes(&plain.tree, plain.tree.root))
+
+	for k, v := range c.ref {
+		assert.Equal(t, []byte(v), c.get([]byte(k)))
+	}
+	i := 0
+	for k := range c.tree.Scan(nil, nil) {
+		assert.Equal(t, fmt.Sprintf("user:%08d:profile", i), string(k))
+		i++
+	}
+	assert.Equal(t, 5000, i)
+
+	// Turning compression off still reads the compressed pages
+	c.tree.SetCompress(false)
+	for _, i := range keys[:2500] {
+		_, err := c.del(fmt.Sprintf("user:%08d:profile", i))
+		assert.NoError(t, err)
+	}
+	c.tree.SetCompress(true)
+	for _, i := range keys[2500:4000] {
+		_, err := c.del(fmt.Sprintf("user:%08d:profile", i))
+		assert.NoError(t, err)
+	}
+	for k, v := range c.ref {
+		assert.Equal(t, []byte(v), c.get([]byte(k)))
+	}
+	i = 0
+	for range c.tree.Scan(nil, nil) {
+		i++
+	}
+	assert.Equal(t, 1000, i)
+}
+
+func countNodes(tree *BTree, ptr uint64) int {
+	node := tree.getNode(ptr)
+	count := 1
+	if node.bType() == BNODE_NODE {
+		for i := uint16(0); i < node.nKeys(); i++ {
+			count += countNodes(tree, node.getPtr(i))
+		}
+	}
+	return count
+}
+
+// Keys in between a truncated separator and the first key of a leaf
+func TestTruncatedSeparators(t *testing.T) {
+	c := newC()
+	c.tree.SetCompress(true)
+	var keys []string
+	for _, i := range rand.New(rand.NewSource(1)).Perm(3000) {
+		k := fmt.Sprintf("user:%08d", 2*i)
+		keys = append(keys, k)
+		assert.NoError(t, c.add(k, strings.Repeat("v", i%200)))
+	}
+	sort.Strings(keys)
+
+	// odd keys share the separators of even ones
+	for i := 1; i < 6000; i += 2 {
+		k := fmt.Sprintf("user:%08d", i)
+		assert.NoError(t, c.add(k, "odd"))
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	i := 0
+	for k := range c.tree.Scan(nil, nil) {
+		assert.Equal(t, keys[i], string(k))
+		i++
+	}
+	assert.Equal(t, len(keys), i)
+
+	for _, k := range keys {
+		for _, q := range []string{k[:len(k)-1], k} {
+			want := sort.SearchStrings(keys, q+"\x00") - 1
+			le := c.tree.SeekLE([]byte(q))
+			if want < 0 {
+				assert.False(t, le.Valid())
+				continue
+			}
+			got, _ := le.Deref()
+			assert.Equal(t, keys[want], string(got))
+		}
+	}
+}
+
+func TestTruncatedSeparatorsInternal(t *testing.T) {
+	c := newC()
+	c.tree.SetCompress(true)
+	// the last key of an internal node is only the first key of its last kid
+	// keys of that kid above a truncated separator would go to the right
+	kids := 0
+	for i := 0; i < 20000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("a%05d", i), strings.Repeat("v", 100)))
+		if root := c.tree.getNode(c.tree.root); root.nKeys() != uint16(kids) {
+			kids = int(root.nKeys())
+			assert.Empty(t, c.tree.Verify())
+		}
+	}
+	assert.Greater(t, kids, 3)
+}
+
+// A root over 2 leaves, the sentinel with left and a compressed leaf of keys after it
+// the pageBytes of the right leaf is size, so that it only just takes the left one when both are counted apart
+func mergeShape(t *testing.T, left []string, size int) *C {
+	c := newC()
+	c.tree.SetCompress(true)
+	tree := &c.tree
+
+	build := func(keys []string, vals []string) BNode {
+		node := BNode(make([]byte, 2*tree.PageSize()))
+		node.setHeader(tree.nodeType(BNODE_LEAF), uint16(len(keys)))
+		for i := range keys {
+			nodeAppendKV(node, uint16(i), 0, []byte(keys[i]), []byte(vals[i]))
+		}
+		return node[:node.nBytes()]
+	}
+	// long shared prefixes, so that the leaf is only a page once compressed
+	rkeys, rvals := []string{}, []string{}
+	for i := 0; i < 80; i++ {
+		rkeys, rvals = append(rkeys, fmt.Sprintf("b:%040d", i)), append(rvals, "v")
+	}
+	right := build(rkeys, rvals)
+	// the last value takes up the rest
+	rvals[len(rvals)-1] = strings.Repeat("v", 1+size-tree.pageBytes(right))
+	right = build(rkeys, rvals)
+	assert.Equal(t, size, tree.pageBytes(right))
+	assert.Greater(t, right.nBytes(), tree.PageSize())
+
+	lkeys := append([]string{""}, left...)
+	lvals := make([]string, len(lkeys))
+	leftNode := build(lkeys, lvals)
+
+	kids := []BNode{leftNode, right}
+	root := BNode(make([]byte, tree.PageSize()))
+	root.setHeader(tree.nodeType(BNODE_NODE), 2)
+	for i, kid := range kids {
+		hi := []byte(nil)
+		if i == 0 {
+			hi = kidKey(tree, kids, 1)
+		}
+		nodeAppendKV(root, uint16(i), tree.newNode(kid, hi), kidKey(tree, kids, i), countVal(nodeCount(tree, kid)))
+	}
+	tree.root = tree.new(root)
+	for i := 1; i < len(lkeys); i++ {
+		c.ref[lkeys[i]] = lvals[i]
+	}
+	for i := range rkeys {
+		c.ref[rkeys[i]] = rvals[i]
+	}
+	assert.Empty(t, tree.Verify())
+	return c
+}
+
+// The merged node is larger than the sum of both when the left one is counted plain
+// each of its keys gets the 6 byte header of the compressed format
+func TestMergeCompressedSibling(t *testing.T) {
+	for _, size := range []int{4064, 4065, 4066, 4067} {
+		c := mergeShape(t, []string{"a", "a1"}, size)
+		_, err := c.del("a1")
+		assert.NoError(t, err)
+		checkMerged(t, c)
+
+		c = mergeShape(t, []string{"a", "a1"}, size)
+		count, err := c.tree.DeleteRange([]byte("a1"), []byte("a2"))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), count)
+		delete(c.ref, "a1")
+		checkMerged(t, c)
+	}
+}
+
+func checkMerged(t *testing.T, c *C) {
+	assert.Empty(t, c.tree.Verify())
+	for k, v := range c.ref {
+		assert.Equal(t, []byte(v), c.get([]byte(k)))
+	}
+	n := 0
+	for range c.tree.Scan(nil, nil) {
+		n++
+	}
+	assert.Equal(t, len(c.ref), n)
+}
@@ -0,0 +1,118 @@
+package btree
+
+import "encoding/binary"
+
+// Internal nodes keep the number of keys under each kid in its value
+// the count includes the sentinel, so the leftmost subtree has one more
+/*
+| count |
+|  8B   |
+*/
+// a node with empty values has its kids counted instead
+
+func countVal(count uint64) []byte {
+	var val [8]byte
+	binary.LittleEndian.PutUint64(val[:], count)
+	return val[:]
+}
+
+// Number of keys under a node
+func nodeCount(tree *BTree, node BNode) uint64 {
+	if node.bType() == BNODE_LEAF {
+		return uint64(node.nKeys())
+	}
+	count := uint64(0)
+	for i := uint16(0); i < node.nKeys(); i++ {
+		count += kidCount(tree, node, i)
+	}
+	return count
+}
+
+// Number of keys under kid idx of an internal node
+func kidCount(tree *BTree, node BNode, idx uint16) uint64 {
+	val := node.getValue(idx)
+	if len(val) == 0 {
+		return nodeCount(tree, tree.getNode(node.getPtr(idx)))
+	}
+	return binary.LittleEndian.Uint64(val)
+}
+
+// Number of keys < key
+func (tree *BTree) Rank(key []byte) (rank uint64, err error) {
+	defer recoverCorrupt(&err)
+	return tree.rank(key), nil
+}
+
+func (tree *BTree) rank(key []byte) uint64 {
+	if tree.root == 0 {
+		return 0
+	}
+	rank := uint64(0)
+	node := tree.getNode(tree.root)
+	for node.bType() == BNODE_NODE {
+		idx := treeLookUp(tree, node, key)
+		for i := uint16(0); i < idx; i++ {
+			rank += kidCount(tree, node, i)
+		}
+		node = tree.getNode(node.getPtr(idx))
+	}
+	rank += uint64(leafRank(tree, node, key))
+	return rank - 1 // the sentinel
+}
+
+// Number of keys < key in a leaf, the sentinel is smaller than any key
+func leafRank(tree *BTree, node BNode, key []byte) uint16 {
+	idx := treeLookUp(tree, node, key)
+	// key[idx] <= key, but a truncated separator can lead to a leaf starting after key
+	if stored := node.getKey(idx); len(stored) == 0 || keyCompare(tree, stored, key) < 0 {
+		return idx + 1
+	}
+	return idx
+}
+
+// Number of keys in [start, end)
+// an empty start or end means there is no bound on that side
+func (tree *BTree) Count(start []byte, end []byte) (count uint64, err error) {
+	defer recoverCorrupt(&err)
+	if tree.root == 0 {
+		return 0, nil
+	}
+	lo, hi := uint64(0), nodeCount(tree, tree.getNode(tree.root))-1
+	if len(start) > 0 {
+		lo = tree.rank(start)
+	}
+	if len(end) > 0 {
+		hi = tree.rank(end)
+	}
+	if hi < lo {
+		return 0, nil
+	}
+	return hi - lo, nil
+}
+
+// Iterator at the key of rank i, counting from 0
+// it is not valid when there are not that many keys
+func (tree *BTree) Select(i uint64) (iter *BIter) {
+	iter = &BIter{tree: tree}
+	defer iter.recover()
+	if tree.root == 0 || i+1 >= nodeCount(tree, tree.getNode(tree.root)) {
+		return iter
+	}
+	i++ // the sentinel
+	for ptr := tree.root; ptr != 0; {
+		node := tree.getNode(ptr)
+		idx := uint16(0)
+		if node.bType() == BNODE_NODE {
+			for c := kidCount(tree, node, idx); i >= c; c = kidCount(tree, node, idx) {
+				i -= c
+				idx++
+			}
+			ptr = node.getPtr(idx)
+		} else {
+			idx, ptr = uint16(i), 0
+		}
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+	}
+	return iter
+}
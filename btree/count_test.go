@@ -0,0 +1,112 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Checks Rank, Count and Select against the sorted keys
+func checkCounts(t *testing.T, tree *BTree, keys []string) {
+	sort.Strings(keys)
+	assert.Equal(t, uint64(len(keys)), must(tree.Count(nil, nil)))
+	for i, k := range keys {
+		assert.Equal(t, uint64(i), must(tree.Rank([]byte(k))))
+		// in between two keys
+		assert.Equal(t, uint64(i+1), must(tree.Rank([]byte(k+"0"))))
+
+		it := tree.Select(uint64(i))
+		assert.True(t, it.Valid())
+		got, _ := it.Deref()
+		assert.Equal(t, k, string(got))
+	}
+	assert.False(t, tree.Select(uint64(len(keys))).Valid())
+}
+
+func TestCounts(t *testing.T) {
+	c := newC()
+	assert.Equal(t, uint64(0), must(c.tree.Count(nil, nil)))
+	assert.Equal(t, uint64(0), must(c.tree.Rank([]byte("a"))))
+	assert.False(t, c.tree.Select(0).Valid())
+
+	perm := rand.New(rand.NewSource(1)).Perm(3000)
+	for _, i := range perm {
+		assert.NoError(t, c.add(fmt.Sprintf("k%05d", i), strings.Repeat("v", i%100)))
+	}
+	keys := []string{}
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	checkCounts(t, &c.tree, keys)
+
+	assert.Equal(t, uint64(100), must(c.tree.Count([]byte("k00100"), []byte("k00200"))))
+	assert.Equal(t, uint64(101), must(c.tree.Count([]byte("k00100"), []byte("k002000"))))
+	assert.Equal(t, uint64(2900), must(c.tree.Count([]byte("k00100"), nil)))
+	assert.Equal(t, uint64(200), must(c.tree.Count(nil, []byte("k00200"))))
+	assert.Equal(t, uint64(0), must(c.tree.Count([]byte("k00200"), []byte("k00100"))))
+
+	// updates keep the count
+	assert.NoError(t, c.add("k00010", "new"))
+	assert.Equal(t, uint64(3000), must(c.tree.Count(nil, nil)))
+
+	for _, i := range perm[:2000] {
+		_, err := c.del(fmt.Sprintf("k%05d", i))
+		assert.NoError(t, err)
+	}
+	keys = keys[:0]
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	checkCounts(t, &c.tree, keys)
+}
+
+func TestCountsCompressed(t *testing.T) {
+	c := newC()
+	c.tree.SetCompress(true)
+	keys := []string{}
+	for _, i := range rand.New(rand.NewSource(2)).Perm(5000) {
+		k := fmt.Sprintf("user:%08d:profile", i)
+		keys = append(keys, k)
+		assert.NoError(t, c.add(k, fmt.Sprint(i)))
+	}
+	checkCounts(t, &c.tree, keys)
+
+	b := newC()
+	assert.NoError(t, b.tree.BulkLoad(bulkKVs(20000), 0.7))
+	assert.Equal(t, uint64(20000), must(b.tree.Count(nil, nil)))
+	k, _ := b.tree.Select(10000).Deref()
+	assert.Equal(t, "key010000", string(k))
+	assert.Equal(t, uint64(10000), must(b.tree.Rank([]byte("key010000"))))
+}
+
+// Internal nodes without counts
+func TestCountsOldNodes(t *testing.T) {
+	c := newC()
+	leaf := func(keys ...string) uint64 {
+		node := BNode(make([]byte, BTREE_PAGE_SIZE))
+		node.setHeader(BNODE_LEAF, uint16(len(keys)))
+		for i, k := range keys {
+			nodeAppendKV(node, uint16(i), 0, []byte(k), []byte("v"))
+		}
+		return c.tree.new(node)
+	}
+	root := BNode(make([]byte, BTREE_PAGE_SIZE))
+	root.setHeader(BNODE_NODE, 2)
+	nodeAppendKV(root, 0, leaf("", "a", "b"), nil, nil)
+	nodeAppendKV(root, 1, leaf("c", "d", "e"), []byte("c"), nil)
+	c.tree.root = c.tree.new(root)
+
+	assert.Equal(t, uint64(5), must(c.tree.Count(nil, nil)))
+	assert.Equal(t, uint64(3), must(c.tree.Rank([]byte("d"))))
+	k, _ := c.tree.Select(3).Deref()
+	assert.Equal(t, "d", string(k))
+
+	// the updated path gets counts, the rest stays as it is
+	assert.NoError(t, c.tree.Insert([]byte("f"), []byte("v")))
+	assert.Equal(t, uint64(6), must(c.tree.Count(nil, nil)))
+	assert.Equal(t, uint64(5), must(c.tree.Rank([]byte("f"))))
+}
@@ -0,0 +1,184 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Formats Dump writes
+const (
+	DUMP_DOT  = 1 // Graphviz, render with `dot -Tsvg`
+	DUMP_JSON = 2
+)
+
+// Keys are cut to this many bytes in a dump
+const DUMP_KEY_SIZE = 24
+
+// A page as it is dumped, the JSON format
+type pageDump struct {
+	Ptr    uint64   `json:"ptr"`
+	Type   string   `json:"type"`             // node, leaf or overflow
+	Format string   `json:"format,omitempty"` // plain or prefix, for nodes and leaves
+	NKeys  int      `json:"nkeys"`
+	Bytes  int      `json:"bytes"` // used bytes of the page
+	Keys   []string `json:"keys,omitempty"`
+	Kids   []uint64 `json:"kids,omitempty"` // kids of a node, overflow pages of a leaf
+	Next   uint64   `json:"next,omitempty"` // next page of an overflow chain
+	Error  string   `json:"error,omitempty"`
+}
+
+type treeDump struct {
+	Root     uint64     `json:"root"`
+	PageSize int        `json:"page_size"`
+	Pages    []pageDump `json:"pages"`
+}
+
+// Writes the pages reachable from the root in format, DUMP_DOT or DUMP_JSON
+// pages are listed depth first, a page that can not be read is listed with its error
+func (tree *BTree) Dump(w io.Writer, format int) error {
+	d := treeDump{Root: tree.root, PageSize: tree.PageSize()}
+	if tree.root != 0 {
+		seen := map[uint64]bool{}
+		tree.dumpPage(&d, seen, tree.root, true)
+	}
+
+	switch format {
+	case DUMP_DOT:
+		return dumpDOT(w, &d)
+	case DUMP_JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(&d)
+	default:
+		return fmt.Errorf("dump: unknown format %d", format)
+	}
+}
+
+// Adds the page at ptr and the pages under it
+// a page reached twice is only listed once
+func (tree *BTree) dumpPage(d *treeDump, seen map[uint64]bool, ptr uint64, isNode bool) {
+	if ptr == 0 || seen[ptr] {
+		return
+	}
+	seen[ptr] = true
+	d.Pages = append(d.Pages, pageDump{Ptr: ptr})
+	page := &d.Pages[len(d.Pages)-1]
+
+	page.Type = "overflow"
+	if isNode {
+		page.Type = "node"
+	}
+	raw, err := tree.dumpRead(ptr)
+	if err == nil && isNode {
+		if kind, _, reason := tree.pageProblem(raw); kind != 0 {
+			err = &ErrCorrupt{Page: ptr, Reason: reason}
+		}
+	}
+	if err != nil {
+		page.Error = err.Error()
+		return
+	}
+
+	if !isNode {
+		ovf := ONode(raw)
+		page.Bytes, page.Next = OVERFLOW_HEADER+int(ovf.size()), ovf.getNext()
+		if BNode(raw).bType() != BNODE_OVERFLOW || page.Bytes > len(raw) {
+			page.Error = "not an overflow page"
+			return
+		}
+		tree.dumpPage(d, seen, page.Next, false)
+		return
+	}
+
+	node := BNode(raw)
+	page.NKeys, page.Bytes, page.Format = int(node.nKeys()), node.nBytes(), "plain"
+	if node.format() == BNODE_FORMAT_PREFIX {
+		page.Format = "prefix"
+		node = nodeDecompress(node)
+	}
+	if node.bType() == BNODE_LEAF {
+		page.Type = "leaf"
+	}
+	kids := []uint64{}
+	for i := uint16(0); i < node.nKeys(); i++ {
+		key := node.getKey(i)
+		page.Keys = append(page.Keys, dumpKey(key))
+		if node.bType() == BNODE_NODE {
+			kids = append(kids, node.getPtr(i))
+			continue
+		}
+		if ovf := node.getPtr(i); ovf != 0 {
+			kids = append(kids, ovf)
+		}
+		if keySpilled(key) {
+			kids = append(kids, binary.LittleEndian.Uint64(key[BTREE_KEY_PREFIX:]))
+		}
+	}
+	page.Kids = kids
+	// page points into d.Pages, which grows below
+	for _, kid := range kids {
+		tree.dumpPage(d, seen, kid, node.bType() == BNODE_NODE)
+	}
+}
+
+// Reads a page, the storage may panic with ErrCorrupt on a bad pointer
+func (tree *BTree) dumpRead(ptr uint64) (page []byte, err error) {
+	defer recoverCorrupt(&err)
+	return tree.get(ptr), nil
+}
+
+// Printable form of a key, cut to DUMP_KEY_SIZE bytes
+func dumpKey(key []byte) string {
+	cut := len(key) > DUMP_KEY_SIZE
+	if cut {
+		key = key[:DUMP_KEY_SIZE]
+	}
+	s := strconv.Quote(string(key))
+	s = s[1 : len(s)-1]
+	if cut {
+		s += "..."
+	}
+	return s
+}
+
+func dumpDOT(w io.Writer, d *treeDump) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "digraph btree {\n")
+	fmt.Fprintf(out, "\tnode [shape=box fontname=monospace];\n")
+	for _, page := range d.Pages {
+		lines := []string{fmt.Sprintf("page %d %s", page.Ptr, page.Type)}
+		switch {
+		case page.Error != "":
+			lines = append(lines, page.Error)
+		case page.Type == "overflow":
+			lines = append(lines, fmt.Sprintf("%d/%d bytes", page.Bytes, d.PageSize))
+		default:
+			lines = append(lines, fmt.Sprintf("%d keys %s, %d/%d bytes", page.NKeys, page.Format, page.Bytes, d.PageSize))
+			for _, key := range page.Keys {
+				lines = append(lines, `"`+key+`"`)
+			}
+		}
+		for i, line := range lines {
+			lines[i] = dotEscape(line)
+		}
+		fmt.Fprintf(out, "\tp%d [label=\"%s\\l\"];\n", page.Ptr, strings.Join(lines, "\\l"))
+		for _, kid := range page.Kids {
+			fmt.Fprintf(out, "\tp%d -> p%d;\n", page.Ptr, kid)
+		}
+		if page.Next != 0 {
+			fmt.Fprintf(out, "\tp%d -> p%d;\n", page.Ptr, page.Next)
+		}
+	}
+	fmt.Fprintf(out, "}\n")
+	return out.Flush()
+}
+
+// A line of a DOT label
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,110 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dumpJSON(t *testing.T, c *C) treeDump {
+	var buf bytes.Buffer
+	assert.NoError(t, c.tree.Dump(&buf, DUMP_JSON))
+	var d treeDump
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &d))
+	return d
+}
+
+func TestDumpJSON(t *testing.T) {
+	c := newC()
+	assert.Equal(t, 0, len(dumpJSON(t, c).Pages))
+
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%04d", i), strings.Repeat("v", 50)))
+	}
+	assert.NoError(t, c.add("big", strings.Repeat("v", 10000)))
+	long := strings.Repeat("x", 100)
+	assert.NoError(t, c.add(long, "v"))
+
+	d := dumpJSON(t, c)
+	assert.Equal(t, c.tree.root, d.Root)
+	assert.Equal(t, BTREE_PAGE_SIZE, d.PageSize)
+	// every page is listed once, the root first
+	ptrs := map[uint64]bool{}
+	for _, page := range d.Pages {
+		assert.False(t, ptrs[page.Ptr])
+		assert.Contains(t, c.pages, page.Ptr)
+		ptrs[page.Ptr] = true
+	}
+	assert.Equal(t, c.tree.root, d.Pages[0].Ptr)
+	assert.Equal(t, "node", d.Pages[0].Type)
+
+	types := map[string]int{}
+	keys := 0
+	for _, page := range d.Pages {
+		assert.Empty(t, page.Error)
+		types[page.Type]++
+		switch page.Type {
+		case "leaf":
+			keys += page.NKeys
+			assert.Equal(t, BNode(c.pages[page.Ptr]).nBytes(), page.Bytes)
+		case "overflow":
+			assert.LessOrEqual(t, page.Bytes, BTREE_PAGE_SIZE)
+		}
+	}
+	assert.Equal(t, 3, types["overflow"])
+	assert.Equal(t, 1+302, keys)
+	assert.Equal(t, len(d.Pages[0].Keys), len(d.Pages[0].Kids))
+
+	// keys are cut
+	found := false
+	for _, page := range d.Pages {
+		for _, key := range page.Keys {
+			found = found || key == long[:DUMP_KEY_SIZE]+"..."
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestDumpDOT(t *testing.T) {
+	c := newC()
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k\"%04d", i), strings.Repeat("v", 50)))
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, c.tree.Dump(&buf, DUMP_DOT))
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "digraph btree {\n"))
+	assert.True(t, strings.HasSuffix(out, "}\n"))
+	root := BNode(c.pages[c.tree.root])
+	assert.Contains(t, out, fmt.Sprintf("p%d -> p%d;", c.tree.root, root.getPtr(0)))
+	assert.Contains(t, out, fmt.Sprintf("%d keys plain, %d/%d bytes", root.nKeys(), root.nBytes(), BTREE_PAGE_SIZE))
+	// quotes in keys are escaped for the label
+	assert.Contains(t, out, `\"k\\\"0000\"`)
+
+	assert.Error(t, c.tree.Dump(&buf, 0))
+}
+
+func TestDumpCorrupt(t *testing.T) {
+	c, ptr := corruptTree(t)
+	d := dumpJSON(t, c)
+	found := false
+	for _, page := range d.Pages {
+		if page.Ptr == ptr {
+			assert.Contains(t, page.Error, "node type 9")
+			found = true
+		} else {
+			assert.Empty(t, page.Error)
+		}
+	}
+	assert.True(t, found)
+
+	// a kid pointing back at the root is listed once
+	root := c.pages[c.tree.root]
+	binary.LittleEndian.PutUint64(root[HEADER:], c.tree.root)
+	assert.Equal(t, len(d.Pages)-1, len(dumpJSON(t, c).Pages))
+}
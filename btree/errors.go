@@ -0,0 +1,55 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the tree, compare with errors.Is
+var (
+	ErrNotFound      = errors.New("key not found")
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+)
+
+// A page that does not make sense
+// errors.Is(err, &ErrCorrupt{}) matches any corrupt page, errors.As gives the details
+type ErrCorrupt struct {
+	Page   uint64 // 0 when it is not known
+	Reason string
+}
+
+func (e *ErrCorrupt) Error() string {
+	return fmt.Sprintf("corrupt page %d: %s", e.Page, e.Reason)
+}
+
+func (e *ErrCorrupt) Is(target error) bool {
+	_, ok := target.(*ErrCorrupt)
+	return ok
+}
+
+// Corrupt pages are found deep inside the recursion, where there is no error to return
+// they unwind the stack with a panic instead, which the public methods turn back into an error
+func corrupt(ptr uint64, format string, args ...any) {
+	panic(&ErrCorrupt{Page: ptr, Reason: fmt.Sprintf(format, args...)})
+}
+
+// Deferred by the public methods
+func recoverCorrupt(err *error) {
+	if e := corruptFrom(recover()); e != nil {
+		*err = e
+	}
+}
+
+// The corrupt page a panic unwound with
+// recover only works in the deferred function itself, so it is called there and passed in
+// other panics are bugs and are passed on
+func corruptFrom(r any) *ErrCorrupt {
+	if r == nil {
+		return nil
+	}
+	if e, ok := r.(*ErrCorrupt); ok {
+		return e
+	}
+	panic(r)
+}
@@ -0,0 +1,189 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrNotFound(t *testing.T) {
+	c := newC()
+	_, err := c.tree.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = c.tree.Delete([]byte("k"))
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, c.add("k", ""))
+	val, err := c.tree.Get([]byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, val)
+	_, err = c.tree.Get([]byte("j"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	// the sentinel is not a key
+	_, err = c.tree.Get(nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = c.tree.Delete(nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestErrKeyTooLarge(t *testing.T) {
+	c := newC()
+	long := []byte(strings.Repeat("k", BTREE_MAX_KEY_SIZE+1))
+	assert.ErrorIs(t, c.tree.Insert(long, nil), ErrKeyTooLarge)
+	_, err := c.tree.Delete(long)
+	assert.ErrorIs(t, err, ErrKeyTooLarge)
+	assert.ErrorIs(t, CheckLimit(long, nil), ErrKeyTooLarge)
+	assert.ErrorIs(t, c.tree.BulkLoad(func(yield func([]byte, []byte) bool) { yield(long, nil) }, 1), ErrKeyTooLarge)
+}
+
+// A tree whose leaf with k0500 has a bad type
+func corruptTree(t *testing.T) (*C, uint64) {
+	c := newC()
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%04d", i), strings.Repeat("v", 50)))
+	}
+	it := c.tree.SeekGE([]byte("k0500"))
+	parent, idx := it.path[len(it.path)-2], it.pos[len(it.pos)-2]
+	ptr := parent.getPtr(idx)
+	binary.LittleEndian.PutUint16(c.pages[ptr], 9)
+	return c, ptr
+}
+
+func TestErrCorrupt(t *testing.T) {
+	c, ptr := corruptTree(t)
+
+	_, err := c.tree.Get([]byte("k0500"))
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+	var corrupt *ErrCorrupt
+	assert.True(t, errors.As(err, &corrupt))
+	assert.Equal(t, ptr, corrupt.Page)
+	assert.Contains(t, err.Error(), "node type 9")
+
+	// other leaves can still be used
+	val, err := c.tree.Get([]byte("k0001"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(strings.Repeat("v", 50)), val)
+	assert.NoError(t, c.add("k0002", "x"))
+
+	// failed updates leave the tree as it was, and give back what they wrote
+	root, pages := c.tree.root, len(c.pages)
+	assert.ErrorIs(t, c.tree.Insert([]byte("k0500"), nil), &ErrCorrupt{})
+	_, err = c.tree.Delete([]byte("k0500"))
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+	// the keys up to the corrupt leaf are in pages freed on success
+	_, err = c.tree.DeleteRange([]byte("k0100"), []byte("k0600"))
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+	assert.Equal(t, root, c.tree.root)
+	assert.Equal(t, pages, len(c.pages))
+	out := c.tree.Verify()
+	assert.Equal(t, 1, len(out))
+	assert.Equal(t, ptr, out[0].Ptr)
+	_, err = c.tree.Count([]byte("k0600"), nil)
+	assert.NoError(t, err)
+	_, err = c.tree.Rank([]byte("k0500"))
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+
+	// iterators stop
+	it := c.tree.SeekGE([]byte("k0500"))
+	assert.False(t, it.Valid())
+	assert.ErrorIs(t, it.Err(), &ErrCorrupt{})
+	it = c.tree.SeekFirst()
+	n := 0
+	for ; it.Valid(); it.Next() {
+		n++
+	}
+	assert.Less(t, n, 1000)
+	assert.ErrorIs(t, it.Err(), &ErrCorrupt{})
+	assert.NoError(t, c.tree.SeekLast().Err())
+
+	// a scan stops at the corrupt leaf, and says so
+	n = 0
+	for range c.tree.ScanErr(nil, nil, &err) {
+		n++
+	}
+	assert.Less(t, n, 1000)
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+	for range c.tree.ScanErr([]byte("k0600"), nil, &err) {
+	}
+	assert.NoError(t, err)
+}
+
+func TestErrCorruptOverflow(t *testing.T) {
+	c := newC()
+	assert.NoError(t, c.add("k", strings.Repeat("v", 10000)))
+	leaf := c.tree.getNode(c.tree.root)
+	ovf := ONode(c.pages[leaf.getPtr(1)])
+	ovf.setHeader(ovf.size(), c.tree.root) // not an overflow page
+
+	_, err := c.tree.Get([]byte("k"))
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+	it := c.tree.SeekFirst()
+	key, val := it.Deref()
+	assert.Nil(t, key)
+	assert.Nil(t, val)
+	assert.ErrorIs(t, it.Err(), &ErrCorrupt{})
+	for range c.tree.Scan(nil, nil) {
+		t.Fatal("nothing can be read")
+	}
+}
+
+// Mangles the leaf with key, the tree has to report it instead of panicking
+func checkCorruptLeaf(t *testing.T, c *C, key string, reason string, mangle func(page BNode)) {
+	it := c.tree.SeekGE([]byte(key))
+	parent, idx := it.path[len(it.path)-2], it.pos[len(it.pos)-2]
+	ptr := parent.getPtr(idx)
+	mangle(BNode(c.pages[ptr]))
+
+	_, err := c.tree.Get([]byte(key))
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+	assert.Contains(t, err.Error(), reason)
+	assert.ErrorIs(t, c.tree.Insert([]byte(key), []byte("v")), &ErrCorrupt{})
+	_, err = c.tree.Update(&UpdateReq{Key: []byte(key + "x"), Val: []byte("v")})
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+	n := 0
+	for range c.tree.Scan(nil, nil) {
+		n++
+	}
+	assert.Less(t, n, len(c.ref))
+	out := c.tree.Verify()
+	assert.Equal(t, 1, len(out))
+	assert.Equal(t, ptr, out[0].Ptr)
+}
+
+func TestErrCorruptLayout(t *testing.T) {
+	plainTree := func() *C {
+		c := newC()
+		for i := 0; i < 1000; i++ {
+			assert.NoError(t, c.add(fmt.Sprintf("k%04d", i), strings.Repeat("v", 50)))
+		}
+		return c
+	}
+
+	checkCorruptLeaf(t, plainTree(), "k0500", "node type 0", func(page BNode) {
+		clear(page)
+	})
+	checkCorruptLeaf(t, plainTree(), "k0500", "no keys", func(page BNode) {
+		clear(page)
+		page.setHeader(BNODE_LEAF, 0)
+	})
+	checkCorruptLeaf(t, plainTree(), "k0500", "key of 65535", func(page BNode) {
+		binary.LittleEndian.PutUint16(page[page.KVPos(0):], 0xffff)
+	})
+	checkCorruptLeaf(t, plainTree(), "k0500", "value of 65535", func(page BNode) {
+		binary.LittleEndian.PutUint16(page[page.KVPos(1)+2:], 0xffff)
+	})
+
+	c := newC()
+	c.tree.SetCompress(true)
+	for i := 0; i < 2000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("user:%08d:profile", i), fmt.Sprint(i)))
+	}
+	checkCorruptLeaf(t, c, "user:00001000:profile", "shares 65535", func(page BNode) {
+		assert.Equal(t, BNODE_FORMAT_PREFIX, page.format())
+		binary.LittleEndian.PutUint16(page[page.KVPos(1):], 0xffff)
+	})
+}
@@ -0,0 +1,80 @@
+package btree
+
+import "encoding/binary"
+
+// High fence keys of leaves
+// with copy-on-write a leaf can not link to its neighbours, their pages change with every update
+// and every link to them would have to be rewritten, up to the whole leaf level
+// a leaf keeps the separator on its right instead, as it was when the leaf was written,
+// and a scan finds the next leaf from the root with it, see Scan
+//
+// the keys of a leaf are below its fence and the keys of the leaves right of it are not
+// separators only grow while a leaf is not rewritten, so the fence stays at or below the one in the parent
+// it falls behind when the first keys of the leaf on its right are deleted, the scan then lands on
+// the leaf itself and steps right of it
+//
+// | fence | len+1 2B | at the end of the page, after the content
+// a 0 is a leaf without a fence, it did not fit or the page was written before fences
+// a 1 is the rightmost leaf, which has no separator on its right
+const FENCE_LEN_SIZE = 2
+
+// Sets the high fence of a leaf page, nil for the rightmost leaf
+// it is left out when it does not fit after the content, or when it is a spilled key:
+// its tail belongs to the first key of the next leaf, which may be deleted while the fence stays
+func setLeafFence(page BNode, hi []byte) {
+	end := len(page) - FENCE_LEN_SIZE
+	if page.bType() != BNODE_LEAF || page.nBytes() > end {
+		return
+	}
+	clear(page[page.nBytes():])
+	if page.nBytes()+len(hi) <= end && !keySpilled(hi) {
+		copy(page[end-len(hi):], hi)
+		binary.LittleEndian.PutUint16(page[end:], uint16(len(hi)+1))
+	}
+}
+
+// High fence of a leaf page, a stored key
+// ok is false when it has none, a nil hi with ok is the rightmost leaf
+func leafFence(page BNode) (hi []byte, ok bool) {
+	end := len(page) - FENCE_LEN_SIZE
+	if page.bType() != BNODE_LEAF || page.nBytes() > end {
+		return nil, false // the content reaches the end of the page
+	}
+	switch n := int(binary.LittleEndian.Uint16(page[end:])); n {
+	case 0:
+		return nil, false
+	case 1:
+		return nil, true
+	default:
+		return page[end-(n-1) : end], true
+	}
+}
+
+// What is wrong with the fence of a page, see pageProblem
+func fenceProblem(page BNode) string {
+	end := len(page) - FENCE_LEN_SIZE
+	if page.bType() != BNODE_LEAF || page.nBytes() > end {
+		return ""
+	}
+	if n := int(binary.LittleEndian.Uint16(page[end:])); n > 0 && page.nBytes()+n-1 > end {
+		return "high fence does not fit after the keys"
+	}
+	return ""
+}
+
+// High fence of kid idx, the separator on its right
+// hi is the one of node
+func kidFence(node BNode, idx uint16, hi []byte) []byte {
+	if idx+1 < node.nKeys() {
+		return node.getKey(idx + 1)
+	}
+	return hi
+}
+
+// High fence of kids[i], the kids replacing kid idx of node
+func splitFence(tree *BTree, kids []BNode, i int, node BNode, idx uint16, hi []byte) []byte {
+	if i+1 < len(kids) {
+		return kidKey(tree, kids, i+1)
+	}
+	return kidFence(node, idx, hi)
+}
@@ -0,0 +1,325 @@
+package btree
+
+import "iter"
+
+// B+Tree Iterator
+// keeps the path from the root to the current leaf
+// so that it can move both ways without searching again, Scan only goes forward and keeps no path
+type BIter struct {
+	tree *BTree
+	path []BNode  // nodes from root to leaf
+	pos  []uint16 // index into each node of the path
+	err  error    // a corrupt page was found
+}
+
+// Why the iterator stopped early, nil if it did not
+func (iter *BIter) Err() error {
+	return iter.err
+}
+
+// Deferred by the methods moving the iterator
+// a corrupt page makes the iterator invalid for good
+func (iter *BIter) recover() {
+	if e := corruptFrom(recover()); e != nil {
+		iter.err = e
+		iter.path, iter.pos = nil, nil
+	}
+}
+
+// Find the largest key <= key
+func (tree *BTree) SeekLE(key []byte) (iter *BIter) {
+	iter = &BIter{tree: tree}
+	defer iter.recover()
+	for ptr := tree.root; ptr != 0; {
+		node := tree.getNode(ptr)
+		idx := treeLookUp(iter.tree, node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.bType() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
+	}
+	// a truncated separator can lead to a leaf starting after key
+	if iter.Valid() && tree.compare(iter.key(), key) > 0 {
+		iter.Prev()
+	}
+	return iter
+}
+
+// Find the smallest key >= key
+func (tree *BTree) SeekGE(key []byte) (iter *BIter) {
+	iter = tree.SeekLE(key)
+	defer iter.recover()
+	if !iter.Valid() {
+		// either an empty tree or we landed on the sentinel
+		iter.Next()
+		return iter
+	}
+	if tree.compare(iter.key(), key) < 0 {
+		iter.Next()
+	}
+	return iter
+}
+
+// Find the first key
+// we go down the leftmost path to the sentinel and step past it
+// the empty key is not the smallest one for every comparator
+func (tree *BTree) SeekFirst() (iter *BIter) {
+	iter = &BIter{tree: tree}
+	defer iter.recover()
+	for ptr := tree.root; ptr != 0; {
+		node := tree.getNode(ptr)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, 0)
+		if node.bType() == BNODE_NODE {
+			ptr = node.getPtr(0)
+		} else {
+			ptr = 0
+		}
+	}
+	if !iter.Valid() {
+		iter.Next()
+	}
+	return iter
+}
+
+// Find the last key
+func (tree *BTree) SeekLast() (iter *BIter) {
+	iter = &BIter{tree: tree}
+	defer iter.recover()
+	for ptr := tree.root; ptr != 0; {
+		node := tree.getNode(ptr)
+		idx := node.nKeys() - 1
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.bType() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
+	}
+	return iter
+}
+
+// Iterates over the keys in [start, end) in order
+// an empty start or end means there is no bound on that side
+// it stops at a corrupt page, use ScanErr to tell
+//
+// it holds a leaf at a time, the next one is found from the root with its high fence, see leafFence
+func (tree *BTree) Scan(start []byte, end []byte) iter.Seq2[[]byte, []byte] {
+	return tree.ScanErr(start, end, nil)
+}
+
+// Scan that sets *err to the corrupt page it stopped at, and to nil when it got to the end
+// err may be nil
+func (tree *BTree) ScanErr(start []byte, end []byte, err *error) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		leaf, e := tree.scanStart(start)
+		defer func() {
+			if err != nil {
+				*err = e
+			}
+		}()
+		for e == nil && leaf.ptr != 0 {
+			// the keys of a leaf are below its high fence, they are only compared with end
+			// in the leaf where end falls
+			check := len(end) > 0 && (!leaf.fenced || leaf.hi == nil || keyCompare(tree, leaf.hi, end) > 0)
+			for ; leaf.idx < leaf.node.nKeys(); leaf.idx++ {
+				var key, val []byte
+				key, val, e = tree.scanKV(&leaf)
+				if e != nil {
+					return
+				}
+				if check && tree.compare(key, end) >= 0 {
+					return
+				}
+				if !yield(key, val) {
+					return
+				}
+			}
+			leaf, e = tree.scanNext(&leaf)
+		}
+	}
+}
+
+// The leaf a scan is in
+type scanLeaf struct {
+	ptr    uint64 // 0 past the last leaf
+	node   BNode
+	idx    uint16 // next key
+	hi     []byte // high fence
+	fenced bool   // whether the leaf has one
+}
+
+// Leaf of the first key >= start
+func (tree *BTree) scanStart(start []byte) (leaf scanLeaf, err error) {
+	defer recoverCorrupt(&err)
+	if tree.root == 0 {
+		return scanLeaf{}, nil
+	}
+	if len(start) == 0 {
+		leaf = tree.scanDescend(nil, 0)
+		if len(leaf.node.getKey(0)) == 0 {
+			leaf.idx = 1 // the sentinel
+		}
+		return leaf, nil
+	}
+	// a truncated separator can lead to a leaf starting after start
+	// and it may have no key >= start, the scan then moves to the next leaf
+	leaf = tree.scanDescend(start, 0)
+	leaf.idx = treeLookUp(tree, leaf.node, start)
+	if key := leaf.node.getKey(leaf.idx); len(key) == 0 || keyCompare(tree, key, start) < 0 {
+		leaf.idx++
+	}
+	return leaf, nil
+}
+
+// Leaf after the one a scan is done with
+func (tree *BTree) scanNext(prev *scanLeaf) (leaf scanLeaf, err error) {
+	defer recoverCorrupt(&err)
+	// a leaf without a fence is found again from its last key
+	last := keyFull(tree, prev.node.getKey(prev.node.nKeys()-1))
+	switch {
+	case !prev.fenced:
+		leaf = tree.scanDescend(last, prev.ptr)
+	case prev.hi == nil:
+		return scanLeaf{}, nil // the rightmost leaf
+	default:
+		leaf = tree.scanDescend(keyFull(tree, prev.hi), prev.ptr)
+	}
+	// a bad fence could send the scan back
+	if leaf.ptr != 0 && keyCompare(tree, leaf.node.getKey(0), last) <= 0 {
+		corrupt(leaf.ptr, "leaf after page %d does not start after its keys", prev.ptr)
+	}
+	return leaf, nil
+}
+
+// Goes down to the leaf where key falls, the leftmost one for a nil key
+// when that is the leaf at after, it goes on to the leaf right of it: the lowest node on the way
+// with a kid right of the path leads there, a zero ptr when there is none
+// a fence behind the separator in the parent lands on the leaf it came from
+func (tree *BTree) scanDescend(key []byte, after uint64) scanLeaf {
+	ptr, right := tree.root, uint64(0)
+	for {
+		node, hi, fenced := tree.getLeaf(ptr)
+		if node.bType() == BNODE_LEAF {
+			if ptr != after {
+				return scanLeaf{ptr: ptr, node: node, hi: hi, fenced: fenced}
+			}
+			if right == 0 {
+				return scanLeaf{}
+			}
+			ptr, right, key, after = right, 0, nil, 0
+			continue
+		}
+		idx := uint16(0)
+		if key != nil {
+			idx = treeLookUp(tree, node, key)
+		}
+		if idx+1 < node.nKeys() {
+			right = node.getPtr(idx + 1)
+		}
+		ptr = node.getPtr(idx)
+	}
+}
+
+// KV the scan is at
+func (tree *BTree) scanKV(leaf *scanLeaf) (key []byte, val []byte, err error) {
+	defer recoverCorrupt(&err)
+	return keyFull(tree, leaf.node.getKey(leaf.idx)), leafValue(tree, leaf.node, leaf.idx), nil
+}
+
+// An iterator is valid when it points to an actual key
+// the sentinel and the position past the last key are not valid
+func (iter *BIter) Valid() bool {
+	if len(iter.path) == 0 {
+		return false
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nKeys() {
+		return false
+	}
+	return !iter.atSentinel()
+}
+
+// The sentinel is the first key of the leftmost leaf
+func (iter *BIter) atSentinel() bool {
+	for _, idx := range iter.pos {
+		if idx != 0 {
+			return false
+		}
+	}
+	last := len(iter.path) - 1
+	return len(iter.path[last].getKey(0)) == 0
+}
+
+// Current KV pair
+// the slices are only valid until the tree is updated
+// both are nil when the KV can not be read, see Err
+func (iter *BIter) Deref() (key []byte, val []byte) {
+	defer iter.recover()
+	last := len(iter.path) - 1
+	node, idx := iter.path[last], iter.pos[last]
+	return keyFull(iter.tree, node.getKey(idx)), leafValue(iter.tree, node, idx)
+}
+
+// Current key without reading its value
+func (iter *BIter) key() []byte {
+	last := len(iter.path) - 1
+	return keyFull(iter.tree, iter.path[last].getKey(iter.pos[last]))
+}
+
+// Move to the next key
+// moving past the last key makes the iterator invalid
+func (iter *BIter) Next() {
+	defer iter.recover()
+	if len(iter.path) == 0 {
+		return
+	}
+	last := len(iter.path) - 1
+	if !iterNext(iter, last) {
+		iter.pos[last] = iter.path[last].nKeys()
+	}
+}
+
+// Move to the previous key
+// moving before the first key leaves the iterator on the sentinel
+func (iter *BIter) Prev() {
+	defer iter.recover()
+	if len(iter.path) == 0 {
+		return
+	}
+	iterPrev(iter, len(iter.path)-1)
+}
+
+// Advance the node at level
+// when it is exhausted we advance the parent and start at its next kid
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nKeys() {
+		iter.pos[level]++
+	} else if level == 0 || !iterNext(iter, level-1) {
+		return false
+	}
+	if level+1 < len(iter.path) {
+		kid := iter.tree.getNode(iter.path[level].getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
+	return true
+}
+
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] > 0 {
+		iter.pos[level]--
+	} else if level == 0 || !iterPrev(iter, level-1) {
+		return false
+	}
+	if level+1 < len(iter.path) {
+		kid := iter.tree.getNode(iter.path[level].getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nKeys() - 1
+	}
+	return true
+}
@@ -0,0 +1,326 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterEmptyTree(t *testing.T) {
+	c := newC()
+
+	iter := c.tree.SeekGE([]byte("k"))
+	assert.False(t, iter.Valid())
+	iter.Next()
+	iter.Prev()
+	assert.False(t, iter.Valid())
+
+	for range c.tree.Scan(nil, nil) {
+		t.Fatal("empty tree should not yield")
+	}
+}
+
+func TestIterSeek(t *testing.T) {
+	c := newC()
+	// Only even keys so that odd ones fall in between
+	for i := 0; i < 300; i += 2 {
+		assert.NoError(t, c.add(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%03d%s", i, strings.Repeat("x", 50))))
+	}
+	root := BNode(c.tree.get(c.tree.root))
+	assert.Equal(t, BNODE_NODE, root.bType())
+
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("k%03d", i))
+
+		le := c.tree.SeekLE(key)
+		assert.True(t, le.Valid())
+		k, v := le.Deref()
+		assert.Equal(t, fmt.Sprintf("k%03d", i-i%2), string(k))
+		assert.Equal(t, c.ref[string(k)], string(v))
+
+		ge := c.tree.SeekGE(key)
+		if i == 299 {
+			assert.False(t, ge.Valid())
+			continue
+		}
+		assert.True(t, ge.Valid())
+		k, _ = ge.Deref()
+		assert.Equal(t, fmt.Sprintf("k%03d", i+i%2), string(k))
+	}
+
+	// Before the first key we sit on the sentinel
+	le := c.tree.SeekLE([]byte("a"))
+	assert.False(t, le.Valid())
+	le.Next()
+	k, _ := le.Deref()
+	assert.Equal(t, "k000", string(k))
+
+	ge := c.tree.SeekGE(nil)
+	k, _ = ge.Deref()
+	assert.Equal(t, "k000", string(k))
+}
+
+func TestIterNextPrev(t *testing.T) {
+	c := newC()
+	for i := 0; i < 500; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%03d", i), fmt.Sprintf("%0100d", i)))
+	}
+	keys := []string{}
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// Forward over every leaf
+	iter := c.tree.SeekGE(nil)
+	for _, key := range keys {
+		assert.True(t, iter.Valid())
+		k, v := iter.Deref()
+		assert.Equal(t, key, string(k))
+		assert.Equal(t, c.ref[key], string(v))
+		iter.Next()
+	}
+	assert.False(t, iter.Valid())
+	iter.Next() // Stays past the end
+	assert.False(t, iter.Valid())
+
+	// Backward from past the end
+	for i := len(keys) - 1; i >= 0; i-- {
+		iter.Prev()
+		assert.True(t, iter.Valid())
+		k, _ := iter.Deref()
+		assert.Equal(t, keys[i], string(k))
+	}
+	iter.Prev()
+	assert.False(t, iter.Valid())
+	iter.Next()
+	k, _ := iter.Deref()
+	assert.Equal(t, keys[0], string(k))
+}
+
+func TestScan(t *testing.T) {
+	c := newC()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%02d", i), fmt.Sprintf("%0100d", i)))
+	}
+
+	got := []string{}
+	for k, v := range c.tree.Scan([]byte("k10"), []byte("k20")) {
+		assert.Equal(t, c.ref[string(k)], string(v))
+		got = append(got, string(k))
+	}
+	want := []string{}
+	for i := 10; i < 20; i++ {
+		want = append(want, fmt.Sprintf("k%02d", i))
+	}
+	assert.Equal(t, want, got)
+
+	// Unbounded
+	n := 0
+	for range c.tree.Scan(nil, nil) {
+		n++
+	}
+	assert.Equal(t, 100, n)
+
+	// Early break
+	n = 0
+	for range c.tree.Scan([]byte("k50"), nil) {
+		n++
+		if n == 3 {
+			break
+		}
+	}
+	assert.Equal(t, 3, n)
+}
+
+func TestIterFirstLast(t *testing.T) {
+	c := newC()
+	assert.False(t, c.tree.SeekFirst().Valid())
+	assert.False(t, c.tree.SeekLast().Valid())
+
+	assert.NoError(t, c.add("k1", "v1"))
+	k, _ := c.tree.SeekLast().Deref()
+	assert.Equal(t, "k1", string(k))
+
+	// Only the sentinel is left
+	_, err := c.del("k1")
+	assert.NoError(t, err)
+	assert.False(t, c.tree.SeekFirst().Valid())
+	assert.False(t, c.tree.SeekLast().Valid())
+
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%03d", i), strings.Repeat("v", 50)))
+	}
+	k, _ = c.tree.SeekFirst().Deref()
+	assert.Equal(t, "k000", string(k))
+	last := c.tree.SeekLast()
+	k, _ = last.Deref()
+	assert.Equal(t, "k299", string(k))
+	last.Prev()
+	k, _ = last.Deref()
+	assert.Equal(t, "k298", string(k))
+}
+
+// Leaves from left to right as a scan walks them
+func scanLeaves(t *testing.T, tree *BTree) []scanLeaf {
+	leaves := []scanLeaf{}
+	leaf, err := tree.scanStart(nil)
+	for err == nil && leaf.ptr != 0 {
+		leaves = append(leaves, leaf)
+		leaf, err = tree.scanNext(&leaf)
+	}
+	assert.NoError(t, err)
+	return leaves
+}
+
+// Checks a scan gives the keys of c.ref in order
+func checkScan(t *testing.T, c *C) {
+	keys := []string{}
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	n := 0
+	for k, v := range c.tree.Scan(nil, nil) {
+		if assert.Less(t, n, len(keys)) {
+			assert.Equal(t, keys[n], string(k))
+			assert.Equal(t, c.ref[keys[n]], string(v))
+		}
+		n++
+	}
+	assert.Equal(t, len(keys), n)
+}
+
+func TestLeafFences(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		c := newC()
+		c.tree.SetCompress(compress)
+		for i := 0; i < 20000; i++ {
+			assert.NoError(t, c.add(fmt.Sprintf("k%05d", i*7%20000), strings.Repeat("v", 50)))
+		}
+		assert.Equal(t, 3, leafDepth(&c.tree, c.tree.root))
+
+		// the fence of a leaf is above its keys and at or below the keys of the next one
+		leaves := scanLeaves(t, &c.tree)
+		assert.Greater(t, len(leaves), 100)
+		for i, leaf := range leaves {
+			assert.True(t, leaf.fenced)
+			if i+1 == len(leaves) {
+				assert.Nil(t, leaf.hi)
+				break
+			}
+			last := leaf.node.getKey(leaf.node.nKeys() - 1)
+			assert.Greater(t, keyCompare(&c.tree, leaf.hi, last), 0)
+			assert.LessOrEqual(t, keyCompare(&c.tree, leaf.hi, leaves[i+1].node.getKey(0)), 0)
+		}
+		assert.Empty(t, c.tree.Verify())
+
+		// fences fall behind the separators once the first keys of the leaves are deleted
+		for _, leaf := range leaves[1:] {
+			for i := uint16(0); i < 3 && i < leaf.node.nKeys(); i++ {
+				_, err := c.del(string(leaf.node.getKey(i)))
+				assert.NoError(t, err)
+			}
+		}
+		_, err := c.tree.DeleteRange([]byte("k05000"), []byte("k09000"))
+		assert.NoError(t, err)
+		for k := range c.ref {
+			if k >= "k05000" && k < "k09000" {
+				delete(c.ref, k)
+			}
+		}
+		assert.Empty(t, c.tree.Verify())
+		checkScan(t, c)
+	}
+}
+
+func TestLeafFencesBulkLoad(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		c := newC()
+		c.tree.SetCompress(compress)
+		assert.NoError(t, c.tree.BulkLoad(bulkKVs(20000), 0.8))
+		leaves := scanLeaves(t, &c.tree)
+		assert.Greater(t, len(leaves), 100)
+		for i, leaf := range leaves[:len(leaves)-1] {
+			assert.True(t, leaf.fenced)
+			assert.LessOrEqual(t, keyCompare(&c.tree, leaf.hi, leaves[i+1].node.getKey(0)), 0)
+		}
+		assert.Nil(t, leaves[len(leaves)-1].hi)
+		assert.Empty(t, c.tree.Verify())
+	}
+}
+
+// A leaf written before fences, or with no room for one, is found from its last key
+func TestScanWithoutFences(t *testing.T) {
+	c := newC()
+	for i := 0; i < 5000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%05d", i*7%5000), strings.Repeat("v", 50)))
+	}
+	leaves := scanLeaves(t, &c.tree)
+	for _, leaf := range leaves[:len(leaves)/2] {
+		page := c.pages[leaf.ptr]
+		clear(page[page.nBytes():])
+	}
+	assert.Empty(t, c.tree.Verify())
+	checkScan(t, c)
+	assert.Equal(t, len(leaves), len(scanLeaves(t, &c.tree)))
+
+	// a fence that does not fit, and one below the keys of its leaf
+	page := c.pages[leaves[len(leaves)-2].ptr]
+	binary.LittleEndian.PutUint16(page[len(page)-FENCE_LEN_SIZE:], 0xffff)
+	assert.Equal(t, VIOLATION_BAD_SIZE, c.tree.Verify()[0].Kind)
+	setLeafFence(page, []byte("k00000"))
+	problems := c.tree.Verify()
+	if assert.Len(t, problems, 1) {
+		assert.Equal(t, VIOLATION_FENCE, problems[0].Kind)
+	}
+	for range c.tree.Scan(nil, nil) {
+	}
+	_, err := c.tree.scanNext(&leaves[len(leaves)-2])
+	assert.ErrorAs(t, err, new(*ErrCorrupt))
+}
+
+func TestScanRange(t *testing.T) {
+	c := newC()
+	c.tree.SetCompress(true)
+	for i := 0; i < 5000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%05d", i), strings.Repeat("v", i%100)))
+	}
+	// ends on a fence, inside a leaf, between keys, and past the last key
+	fence := c.tree.scanDescend([]byte("k02500"), 0).hi
+	assert.NotNil(t, fence)
+	for _, end := range []string{string(fence), "k03001", "k03001x", "z"} {
+		n := 0
+		for k := range c.tree.Scan([]byte("k02000"), []byte(end)) {
+			assert.Equal(t, fmt.Sprintf("k%05d", 2000+n), string(k))
+			n++
+		}
+		assert.Equal(t, countBelow(end)-2000, n)
+	}
+}
+
+// Number of k%05d keys below end
+func countBelow(end string) int {
+	return sort.Search(5000, func(i int) bool { return fmt.Sprintf("k%05d", i) >= end })
+}
+
+// Every leaf is read once, with the nodes on the way down to it
+func TestScanReadsLeavesOnce(t *testing.T) {
+	c := newC()
+	for i := 0; i < 20000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%05d", i), strings.Repeat("v", 50)))
+	}
+	leaves, depth := len(scanLeaves(t, &c.tree)), leafDepth(&c.tree, c.tree.root)
+	counting := &CountingStore{PageStore: c.tree.Store()}
+	c.tree.SetStore(counting)
+	n := 0
+	for range c.tree.Scan(nil, nil) {
+		n++
+	}
+	assert.Equal(t, 20000, n)
+	assert.Equal(t, leaves*depth, counting.Gets)
+}
@@ -0,0 +1,174 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Values larger than BTREE_MAX_VAL_SIZE are stored in a chain of overflow pages
+// the leaf keeps the first page in its pointer slot (unused for leaves)
+// and the total size of the value in place of the value
+/*
+overflow page format
+|  2B  |  2B  |    4B    |  8B  |  ...   |
+| type | size | checksum | next |  data  |
+*/
+const BNODE_OVERFLOW = uint16(3)
+const OVERFLOW_HEADER = 16
+const OVERFLOW_CAP = BTREE_PAGE_SIZE - OVERFLOW_HEADER // with the default page size
+
+// Largest value, it is read into memory as a whole
+const OVERFLOW_MAX_SIZE = 1 << 30
+
+type ONode []byte
+
+func (node ONode) size() uint16 {
+	return binary.LittleEndian.Uint16(node[2:4])
+}
+func (node ONode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(node[8:16])
+}
+func (node ONode) data() []byte {
+	return node[OVERFLOW_HEADER:][:node.size()]
+}
+
+func (node ONode) setHeader(size uint16, next uint64) {
+	binary.LittleEndian.PutUint16(node[0:2], BNODE_OVERFLOW)
+	binary.LittleEndian.PutUint16(node[2:4], size)
+	binary.LittleEndian.PutUint64(node[8:16], next)
+}
+
+// Writes data to a new chain of overflow pages and returns the first page
+// pages are allocated from the end so each one knows its next page
+func overflowWrite(tree *BTree, data []byte) uint64 {
+	next := uint64(0)
+	capacity := tree.PageSize() - OVERFLOW_HEADER
+	for end := len(data); end > 0; {
+		begin := (end - 1) / capacity * capacity
+		node := ONode(make([]byte, tree.PageSize()))
+		node.setHeader(uint16(end-begin), next)
+		copy(node[OVERFLOW_HEADER:], data[begin:end])
+		next = tree.new(node)
+		end = begin
+	}
+	return next
+}
+
+// Reads size bytes from the chain starting at ptr
+func overflowRead(tree *BTree, ptr uint64, size uint64) []byte {
+	head := ptr
+	data := make([]byte, 0, min(size, OVERFLOW_MAX_SIZE))
+	for ptr != 0 {
+		node := ONode(tree.get(ptr))
+		if BNode(node).bType() != BNODE_OVERFLOW || OVERFLOW_HEADER+int(node.size()) > len(node) {
+			corrupt(ptr, "bad overflow page")
+		}
+		data = append(data, node.data()...)
+		ptr = node.getNext()
+		if uint64(len(data)) > size {
+			break // a corrupt chain may not end
+		}
+	}
+	if uint64(len(data)) != size {
+		corrupt(head, "overflow chain holds %d bytes instead of %d", len(data), size)
+	}
+	return data
+}
+
+// Gives every page of the chain back
+func overflowFree(tree *BTree, ptr uint64) {
+	for ptr != 0 {
+		next := ONode(tree.get(ptr)).getNext()
+		tree.del(ptr)
+		ptr = next
+	}
+}
+
+// Value as it is stored in the leaf and the head of its chain
+// small values are stored in place and have no chain
+func overflowPack(tree *BTree, val []byte) ([]byte, uint64) {
+	if len(val) <= BTREE_MAX_VAL_SIZE {
+		return val, 0
+	}
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(val)))
+	return size[:], overflowWrite(tree, val)
+}
+
+// Full value of a leaf KV
+func leafValue(tree *BTree, node BNode, idx uint16) []byte {
+	ptr := node.getPtr(idx)
+	if ptr == 0 {
+		return node.getValue(idx)
+	}
+	size := binary.LittleEndian.Uint64(node.getValue(idx))
+	return overflowRead(tree, ptr, size)
+}
+
+// Keys larger than BTREE_MAX_KEY_SIZE are only stored when the tree has long keys enabled
+// the first BTREE_KEY_PREFIX bytes stay in the node and the tail spills to overflow pages
+// the tail is only read when comparing against a key with the same prefix
+/*
+spilled key format
+|     1000B     |  8B  |     8B    |
+|    prefix     | tail | tail size |
+*/
+// a spilled key is always longer than BTREE_MAX_KEY_SIZE which tells it apart from normal keys
+const BTREE_KEY_PREFIX = BTREE_MAX_KEY_SIZE
+const BTREE_SPILLED_KEY_SIZE = BTREE_KEY_PREFIX + 16
+
+func keySpilled(stored []byte) bool {
+	return len(stored) > BTREE_MAX_KEY_SIZE
+}
+
+// Key as it is stored in a node
+func keySpill(tree *BTree, key []byte) []byte {
+	if len(key) <= BTREE_MAX_KEY_SIZE {
+		return key
+	}
+	stored := make([]byte, BTREE_SPILLED_KEY_SIZE)
+	copy(stored, key[:BTREE_KEY_PREFIX])
+	tail := key[BTREE_KEY_PREFIX:]
+	binary.LittleEndian.PutUint64(stored[BTREE_KEY_PREFIX:], overflowWrite(tree, tail))
+	binary.LittleEndian.PutUint64(stored[BTREE_KEY_PREFIX+8:], uint64(len(tail)))
+	return stored
+}
+
+func keyTail(tree *BTree, stored []byte) []byte {
+	ptr := binary.LittleEndian.Uint64(stored[BTREE_KEY_PREFIX:])
+	size := binary.LittleEndian.Uint64(stored[BTREE_KEY_PREFIX+8:])
+	return overflowRead(tree, ptr, size)
+}
+
+// Full key from the stored one
+func keyFull(tree *BTree, stored []byte) []byte {
+	if !keySpilled(stored) {
+		return stored
+	}
+	return append(stored[:BTREE_KEY_PREFIX:BTREE_KEY_PREFIX], keyTail(tree, stored)...)
+}
+
+func keyFree(tree *BTree, stored []byte) {
+	if keySpilled(stored) {
+		overflowFree(tree, binary.LittleEndian.Uint64(stored[BTREE_KEY_PREFIX:]))
+	}
+}
+
+// Compares a stored key with a full key
+func keyCompare(tree *BTree, stored []byte, key []byte) int {
+	if !keySpilled(stored) {
+		return tree.compare(stored, key)
+	}
+	if !tree.bytewise() {
+		return tree.compare(keyFull(tree, stored), key)
+	}
+	cmp := bytes.Compare(stored[:BTREE_KEY_PREFIX], key[:min(len(key), BTREE_KEY_PREFIX)])
+	if cmp != 0 {
+		return cmp
+	}
+	if len(key) <= BTREE_KEY_PREFIX {
+		return 1 // key is a prefix of the stored key
+	}
+	// prefixes tie, only now we read the tail
+	return bytes.Compare(keyTail(tree, stored), key[BTREE_KEY_PREFIX:])
+}
@@ -0,0 +1,148 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverflowChain(t *testing.T) {
+	c := newC()
+	for _, size := range []int{1, OVERFLOW_CAP, OVERFLOW_CAP + 1, 3*OVERFLOW_CAP + 7} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		ptr := overflowWrite(&c.tree, data)
+		assert.Equal(t, (size+OVERFLOW_CAP-1)/OVERFLOW_CAP, len(c.pages))
+		assert.Equal(t, data, overflowRead(&c.tree, ptr, uint64(size)))
+
+		overflowFree(&c.tree, ptr)
+		assert.Equal(t, 0, len(c.pages))
+	}
+}
+
+func TestOverflowValues(t *testing.T) {
+	c := newC()
+	big := func(i int, size int) string {
+		return string(bytes.Repeat([]byte(fmt.Sprintf("%04d", i)), size/4))
+	}
+
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%02d", i), big(i, 10000+i*400)))
+	}
+	for k, v := range c.ref {
+		assert.Equal(t, []byte(v), c.get([]byte(k)))
+	}
+	// Iterators see the whole value as well
+	for k, v := range c.tree.Scan(nil, nil) {
+		assert.Equal(t, c.ref[string(k)], string(v))
+	}
+
+	// Shrinking the values releases their chains
+	before := len(c.pages)
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%02d", i), "small"))
+	}
+	assert.Less(t, len(c.pages), before)
+	for k, v := range c.ref {
+		assert.Equal(t, []byte(v), c.get([]byte(k)))
+	}
+
+	// Deleting releases every chain
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%02d", i), big(i, 20000)))
+	}
+	for i := 0; i < 50; i++ {
+		_, err := c.del(fmt.Sprintf("k%02d", i))
+		assert.NoError(t, err)
+	}
+	for _, node := range c.pages {
+		assert.NotEqual(t, BNODE_OVERFLOW, node.bType())
+	}
+}
+
+func TestLongKeysDisabled(t *testing.T) {
+	c := newC()
+	long := bytes.Repeat([]byte("k"), BTREE_MAX_KEY_SIZE+1)
+
+	assert.Error(t, c.tree.Insert(long, []byte("v")))
+	_, err := c.tree.Delete(long)
+	assert.Error(t, err)
+}
+
+func TestLongKeys(t *testing.T) {
+	c := newC()
+	c.tree.SetLongKeys(true)
+
+	// All keys share the inline prefix so every comparison reads a tail
+	prefix := string(bytes.Repeat([]byte("p"), BTREE_KEY_PREFIX))
+	keys := []string{
+		prefix[:10],
+		prefix,
+		prefix + "a",
+		prefix + "b",
+		prefix + "b" + string(bytes.Repeat([]byte("x"), 2*OVERFLOW_CAP)),
+		prefix + "c",
+		prefix[:BTREE_KEY_PREFIX-1] + "q",
+	}
+	for i, k := range keys {
+		// Max size values to check that nodes still fit
+		assert.NoError(t, c.add(k, string(bytes.Repeat([]byte{byte('0' + i)}, BTREE_MAX_VAL_SIZE))))
+	}
+	for k, v := range c.ref {
+		assert.Equal(t, []byte(v), c.get([]byte(k)))
+	}
+	assert.Nil(t, c.get([]byte(prefix+"aa")))
+	assert.Nil(t, c.get([]byte(prefix[:BTREE_KEY_PREFIX-1])))
+
+	// Scan returns full keys in order
+	got := []string{}
+	for k := range c.tree.Scan(nil, nil) {
+		got = append(got, string(k))
+	}
+	assert.True(t, assert.ObjectsAreEqual(keys, got))
+	it := c.tree.SeekLE([]byte(prefix + "bz"))
+	k, _ := it.Deref()
+	assert.True(t, keys[4] == string(k))
+
+	// Updating keeps the key, deleting frees the tail
+	assert.NoError(t, c.add(keys[3], "new"))
+	assert.Equal(t, []byte("new"), c.get([]byte(keys[3])))
+	for _, k := range keys {
+		_, err := c.del(k)
+		assert.NoError(t, err)
+	}
+	for _, node := range c.pages {
+		assert.NotEqual(t, BNODE_OVERFLOW, node.bType())
+	}
+}
+
+func TestLongKeysMany(t *testing.T) {
+	c := newC()
+	c.tree.SetLongKeys(true)
+
+	prefix := string(bytes.Repeat([]byte("p"), BTREE_KEY_PREFIX))
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("%s%05d", prefix, (i*7919)%200)
+		assert.NoError(t, c.add(k, fmt.Sprint(i)))
+	}
+	root := BNode(c.tree.get(c.tree.root))
+	assert.Equal(t, BNODE_NODE, root.bType())
+	for k, v := range c.ref {
+		assert.Equal(t, []byte(v), c.get([]byte(k)))
+	}
+	i := 0
+	for k := range c.tree.Scan(nil, nil) {
+		assert.Equal(t, fmt.Sprintf("%s%05d", prefix, i), string(k))
+		i++
+	}
+	assert.Equal(t, 200, i)
+
+	for i := 0; i < 200; i += 3 {
+		_, err := c.del(fmt.Sprintf("%s%05d", prefix, i))
+		assert.NoError(t, err)
+	}
+	for k, v := range c.ref {
+		assert.Equal(t, []byte(v), c.get([]byte(k)))
+	}
+}
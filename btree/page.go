@@ -0,0 +1,111 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/Manik-Jasrai/ByteStore.git/utils"
+)
+
+// Page sizes a tree can use, a power of two in between
+const BTREE_MIN_PAGE_SIZE = 4 << 10
+const BTREE_MAX_PAGE_SIZE = 64 << 10
+
+// Largest page whose nodes are addressed with uint16 offsets
+// a node can grow past 64K in memory before it is split on larger pages
+const BTREE_MAX_NARROW_PAGE = 32 << 10
+
+func CheckPageSize(size int) error {
+	if size < BTREE_MIN_PAGE_SIZE || size > BTREE_MAX_PAGE_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("bad page size %d", size)
+	}
+	return nil
+}
+
+// Size of the pages the tree reads and writes
+// it has to be set before the tree is used and can not change afterwards
+func (tree *BTree) SetPageSize(size int) {
+	utils.Assert(CheckPageSize(size) == nil, "Bad Page Size")
+	tree.pageSize = size
+}
+
+func (tree *BTree) PageSize() int {
+	if tree.pageSize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return tree.pageSize
+}
+
+// Whether nodes of this tree have 4 byte offsets
+func (tree *BTree) wide() bool {
+	return tree.PageSize() > BTREE_MAX_NARROW_PAGE
+}
+
+// Header type of a new node of this tree
+func (tree *BTree) nodeType(btype uint16) uint16 {
+	if tree.wide() {
+		return btype | BNODE_WIDE<<8
+	}
+	return btype
+}
+
+// Largest plain node kept in memory
+func (tree *BTree) maxNodeSize() int {
+	if tree.wide() {
+		return 12 * tree.PageSize()
+	}
+	return BTREE_MAX_NODE_SIZE
+}
+
+// Default fraction of a page below which a node is merged with or evened out with a sibling
+const BTREE_MIN_FILL = 0.25
+
+// Two siblings evened out are each about half of more than a page
+func CheckMinFill(fill float64) error {
+	if !(fill > 0 && fill <= 0.5) {
+		return fmt.Errorf("bad min fill %v", fill)
+	}
+	return nil
+}
+
+// Fraction of a page a node is kept above on delete
+func (tree *BTree) SetMinFill(fill float64) {
+	utils.Assert(CheckMinFill(fill) == nil, "Bad Min Fill")
+	tree.minFill = fill
+}
+
+func (tree *BTree) MinFill() float64 {
+	if tree.minFill == 0 {
+		return BTREE_MIN_FILL
+	}
+	return tree.minFill
+}
+
+// Bytes in a page below which a node is rebalanced
+func (tree *BTree) minFillBytes() int {
+	return int(tree.MinFill() * float64(tree.PageSize()))
+}
+
+// Every page keeps a CRC32C of its content at the same place, whatever its type
+// the storage sets it when a page is written and checks it when it is read
+// the tree only keeps the slot free, its own pages never look at it
+const PAGE_CHECKSUM_OFFSET = 4
+const PAGE_CHECKSUM_SIZE = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum of a page, not counting its checksum slot
+func PageChecksum(page []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, page[:PAGE_CHECKSUM_OFFSET])
+	return crc32.Update(crc, castagnoli, page[PAGE_CHECKSUM_OFFSET+PAGE_CHECKSUM_SIZE:])
+}
+
+func SetPageChecksum(page []byte) {
+	binary.LittleEndian.PutUint32(page[PAGE_CHECKSUM_OFFSET:], PageChecksum(page))
+}
+
+// Whether the page is what was written
+func CheckPageChecksum(page []byte) bool {
+	return binary.LittleEndian.Uint32(page[PAGE_CHECKSUM_OFFSET:]) == PageChecksum(page)
+}
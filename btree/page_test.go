@@ -0,0 +1,112 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPageSize(t *testing.T) {
+	for _, size := range []int{4 << 10, 8 << 10, 16 << 10, 32 << 10, 64 << 10} {
+		assert.NoError(t, CheckPageSize(size))
+	}
+	for _, size := range []int{0, 2 << 10, 5000, 128 << 10} {
+		assert.Error(t, CheckPageSize(size))
+	}
+	assert.Equal(t, BTREE_PAGE_SIZE, (&BTree{}).PageSize())
+}
+
+func TestPageSizes(t *testing.T) {
+	for _, size := range []int{8 << 10, 16 << 10, 64 << 10} {
+		for _, compress := range []bool{false, true} {
+			t.Run(fmt.Sprint(size, compress), func(t *testing.T) {
+				c := newC()
+				c.tree.SetPageSize(size)
+				c.tree.SetCompress(compress)
+
+				keys := rand.New(rand.NewSource(1)).Perm(2000)
+				for _, i := range keys {
+					k := fmt.Sprintf("user:%08d", i)
+					assert.NoError(t, c.add(k, strings.Repeat("v", i%200)))
+				}
+				// a tree with 64K pages has wide nodes
+				root := c.tree.getNode(c.tree.root)
+				assert.Equal(t, BNODE_NODE, root.bType())
+				assert.Equal(t, size > BTREE_MAX_NARROW_PAGE, root.wide())
+				for _, page := range c.pages {
+					assert.Equal(t, size, len(page))
+				}
+
+				for _, i := range keys[:1500] {
+					_, err := c.del(fmt.Sprintf("user:%08d", i))
+					assert.NoError(t, err)
+				}
+				for k, v := range c.ref {
+					assert.Equal(t, []byte(v), c.get([]byte(k)))
+				}
+				n := 0
+				for range c.tree.Scan(nil, nil) {
+					n++
+				}
+				assert.Equal(t, len(c.ref), n)
+			})
+		}
+	}
+}
+
+func TestPageSizeOverflow(t *testing.T) {
+	c := newC()
+	c.tree.SetPageSize(64 << 10)
+	val := strings.Repeat("x", 200000)
+	assert.NoError(t, c.add("k", val))
+	// 65524 bytes fit in every overflow page
+	assert.Equal(t, 5, len(c.pages))
+	assert.Equal(t, []byte(val), c.get([]byte("k")))
+}
+
+func TestPageSizeBulkLoad(t *testing.T) {
+	c := newC()
+	c.tree.SetPageSize(64 << 10)
+	assert.NoError(t, c.tree.BulkLoad(bulkKVs(50000), 1))
+	assert.True(t, c.tree.getNode(c.tree.root).wide())
+	i := 0
+	for k := range c.tree.Scan(nil, nil) {
+		assert.Equal(t, fmt.Sprintf("key%06d", i), string(k))
+		i++
+	}
+	assert.Equal(t, 50000, i)
+}
+
+func TestPageChecksum(t *testing.T) {
+	c := newC()
+	c.tree.SetCompress(true)
+	for i := 0; i < 2000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("user:%06d", i), strings.Repeat("v", i%300)))
+	}
+	assert.NoError(t, c.add("big", strings.Repeat("v", 10000)))
+
+	// what the storage does on write, the tree does not see it
+	for _, page := range c.pages {
+		SetPageChecksum(page)
+		assert.True(t, CheckPageChecksum(page))
+	}
+	assert.Empty(t, c.tree.Verify())
+	assert.Equal(t, []byte(strings.Repeat("v", 10000)), c.get([]byte("big")))
+	n := 0
+	for range c.tree.Scan(nil, nil) {
+		n++
+	}
+	assert.Equal(t, 2001, n)
+
+	for _, page := range c.pages {
+		page[len(page)-1] ^= 1
+		assert.False(t, CheckPageChecksum(page))
+		page[len(page)-1] ^= 1
+		page[0] ^= 1
+		assert.False(t, CheckPageChecksum(page))
+		page[0] ^= 1
+	}
+}
@@ -0,0 +1,198 @@
+package btree
+
+// Deletes the keys in [start, end) and returns how many there were
+// an empty start or end means there is no bound on that side
+// subtrees covered by the range are freed as a whole, only the boundary paths are rewritten
+func (tree *BTree) DeleteRange(start []byte, end []byte) (uint64, error) {
+	if tree.root == 0 {
+		return 0, nil
+	}
+	if len(start) > 0 && len(end) > 0 && tree.compare(start, end) >= 0 {
+		return 0, nil
+	}
+	count := uint64(0)
+	err := tree.atomic(func() error {
+		var updated BNode
+		updated, count = treeDeleteRange(tree, tree.getNode(tree.root), start, end, nil)
+		if count == 0 {
+			return nil
+		}
+		tree.del(tree.root)
+		// the sentinel is never deleted so the root is not empty, but whole levels can go
+		// the root is then a page that is already written
+		ptr := uint64(0)
+		for updated.bType() == BNODE_NODE && updated.nKeys() == 1 {
+			if ptr != 0 {
+				tree.del(ptr)
+			}
+			ptr = updated.getPtr(0)
+			updated = tree.getNode(ptr)
+		}
+		if ptr == 0 {
+			ptr = newRoot(tree, updated, false)
+		}
+		tree.root = ptr
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Deletes the keys in [start, end) under node
+// returns the updated node and the number of keys deleted, an empty node if there were none
+// hi is the high fence of node, see TreeInsert
+func treeDeleteRange(tree *BTree, node BNode, start []byte, end []byte, hi []byte) (BNode, uint64) {
+	switch node.bType() {
+	case BNODE_LEAF:
+		return leafDeleteRange(tree, node, start, end)
+	case BNODE_NODE:
+		return nodeDeleteRange(tree, node, start, end, hi)
+	default:
+		panic("Bad Node")
+	}
+}
+
+func leafDeleteRange(tree *BTree, node BNode, start []byte, end []byte) (BNode, uint64) {
+	lo, hi := uint16(0), node.nKeys()
+	if len(start) > 0 {
+		lo = leafRank(tree, node, start)
+	}
+	if len(end) > 0 {
+		hi = leafRank(tree, node, end)
+	}
+	if lo == 0 && len(node.getKey(0)) == 0 {
+		lo = 1 // keep the sentinel
+	}
+	if lo >= hi {
+		return BNode{}, 0
+	}
+	for i := lo; i < hi; i++ {
+		leafFree(tree, node, i)
+	}
+	new := tree.nodeBuf(node.nBytes())
+	new.setHeader(node.kind(), node.nKeys()-(hi-lo))
+	nodeAppendRange(new, node, 0, 0, lo)
+	nodeAppendRange(new, node, lo, hi, node.nKeys()-hi)
+	return new, uint64(hi - lo)
+}
+
+func nodeDeleteRange(tree *BTree, node BNode, start []byte, end []byte, hi []byte) (BNode, uint64) {
+	first, last := uint16(0), node.nKeys()-1
+	if len(start) > 0 {
+		first = treeLookUp(tree, node, start)
+	}
+	if len(end) > 0 {
+		last = treeLookUp(tree, node, end)
+	}
+
+	count := uint64(0)
+	// kids in between are covered by the range
+	for i := first + 1; i < last; i++ {
+		count += treeFree(tree, node.getPtr(i))
+	}
+	// kids at the boundaries are trimmed, and split if their new keys do not fit
+	bounds := []uint16{first, last}
+	if first == last {
+		bounds = bounds[:1]
+	}
+	changed := [2]bool{}
+	trimmed := [2][]BNode{}
+	for j, i := range bounds {
+		kid, n := treeDeleteRange(tree, tree.getNode(node.getPtr(i)), start, end, kidFence(node, i, hi))
+		if n == 0 {
+			continue
+		}
+		count += n
+		changed[j] = true
+		tree.del(node.getPtr(i))
+		if kid.nKeys() > 0 {
+			nsplit, split := NodeSplit3(tree, kid, false)
+			trimmed[j] = split[:nsplit]
+		}
+	}
+	if count == 0 {
+		return BNode{}, 0
+	}
+
+	// kids before first and after last are kept
+	nkeys := int(first) + int(node.nKeys()-last-1)
+	for j := range bounds {
+		if changed[j] {
+			nkeys += len(trimmed[j])
+		} else {
+			nkeys++
+		}
+	}
+	new := tree.nodeBuf(node.nBytes() + 2*tree.PageSize())
+	new.setHeader(node.kind(), uint16(nkeys))
+	nodeAppendRange(new, node, 0, 0, first)
+	idx := first
+	for j, i := range bounds {
+		if !changed[j] {
+			nodeAppendRange(new, node, idx, i, 1)
+			idx++
+			continue
+		}
+		for k, kid := range trimmed[j] {
+			val := countVal(nodeCount(tree, kid))
+			ptr := tree.newNode(kid, splitFence(tree, trimmed[j], k, node, i, hi))
+			nodeAppendKV(new, idx, ptr, kidKey(tree, trimmed[j], k), val)
+			idx++
+		}
+	}
+	nodeAppendRange(new, node, idx, last+1, node.nKeys()-last-1)
+
+	// the trimmed kids may now be small enough to merge with a sibling
+	for i := int(idx) - 1; i >= int(first) && i < int(new.nKeys()); i-- {
+		new = nodeMergeKid(tree, new, uint16(i), hi)
+	}
+	return new, count
+}
+
+// Merges kid idx with a sibling, or evens them out, if it is small enough
+// hi is the high fence of node
+func nodeMergeKid(tree *BTree, node BNode, idx uint16, hi []byte) BNode {
+	kid := tree.getNode(node.getPtr(idx))
+	mergeDir, sibling := shouldMerge(tree, node, idx, kid)
+	if mergeDir == 0 {
+		new := tree.nodeBuf(node.nBytes() + tree.PageSize())
+		if !nodeBorrow(tree, new, node, idx, kid, hi) {
+			return node
+		}
+		tree.del(node.getPtr(idx))
+		return new
+	}
+	left := idx
+	merged := tree.nodeBuf(sibling.nBytes() + kid.nBytes())
+	if mergeDir == -1 {
+		left = idx - 1
+		nodeMerge(merged, sibling, kid)
+	} else {
+		nodeMerge(merged, kid, sibling)
+	}
+	tree.del(node.getPtr(left))
+	tree.del(node.getPtr(left + 1))
+	// the first key of the merged node may be longer than the truncated one
+	new := tree.nodeBuf(node.nBytes() + tree.PageSize())
+	ptr := tree.newNode(merged, kidFence(node, left+1, hi))
+	NodeReplace2Kid(new, node, left, ptr, merged.getKey(0), nodeCount(tree, merged))
+	return new
+}
+
+// Gives back every page under ptr and returns the number of keys there
+func treeFree(tree *BTree, ptr uint64) uint64 {
+	node := tree.getNode(ptr)
+	count := uint64(0)
+	for i := uint16(0); i < node.nKeys(); i++ {
+		if node.bType() == BNODE_NODE {
+			count += treeFree(tree, node.getPtr(i))
+		} else {
+			leafFree(tree, node, i)
+			count++
+		}
+	}
+	tree.del(ptr)
+	return count
+}
@@ -0,0 +1,158 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Depth of the leaves under ptr, -1 if they are not all at the same depth
+func leafDepth(tree *BTree, ptr uint64) int {
+	node := tree.getNode(ptr)
+	if node.bType() == BNODE_LEAF {
+		return 1
+	}
+	depth := leafDepth(tree, node.getPtr(0))
+	for i := uint16(1); i < node.nKeys(); i++ {
+		if leafDepth(tree, node.getPtr(i)) != depth {
+			return -1
+		}
+	}
+	return depth + 1
+}
+
+// Checks the tree holds exactly the keys of the reference map
+func checkTree(t *testing.T, c *C) {
+	keys := []string{}
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	i := 0
+	for k, v := range c.tree.Scan(nil, nil) {
+		if !assert.Less(t, i, len(keys)) {
+			return
+		}
+		assert.Equal(t, keys[i], string(k))
+		assert.Equal(t, c.ref[keys[i]], string(v))
+		i++
+	}
+	assert.Equal(t, len(keys), i)
+	assert.Equal(t, uint64(len(keys)), must(c.tree.Count(nil, nil)))
+	assert.Greater(t, leafDepth(&c.tree, c.tree.root), 0)
+	assert.Empty(t, c.tree.Verify())
+}
+
+func (c *C) delRange(start string, end string) uint64 {
+	for k := range c.ref {
+		if (start == "" || k >= start) && (end == "" || k < end) {
+			delete(c.ref, k)
+		}
+	}
+	return must(c.tree.DeleteRange([]byte(start), []byte(end)))
+}
+
+func TestDeleteRange(t *testing.T) {
+	c := newC()
+	for _, i := range rand.New(rand.NewSource(1)).Perm(5000) {
+		assert.NoError(t, c.add(fmt.Sprintf("k%05d", i), strings.Repeat("v", i%100)))
+	}
+	assert.Equal(t, uint64(1000), c.delRange("k01000", "k02000"))
+	checkTree(t, c)
+	assert.Nil(t, c.get([]byte("k01500")))
+	assert.NotNil(t, c.get([]byte("k02000")))
+
+	// nothing there
+	assert.Equal(t, uint64(0), c.delRange("k01000", "k02000"))
+	assert.Equal(t, uint64(0), c.delRange("k03000", "k02000"))
+	// a single key
+	assert.Equal(t, uint64(1), c.delRange("k02000", "k02001"))
+	// unbounded on either side
+	assert.Equal(t, uint64(500), c.delRange("", "k00500"))
+	checkTree(t, c)
+	assert.Equal(t, uint64(1000), c.delRange("k04000", ""))
+	checkTree(t, c)
+
+	// the rest can still be updated
+	for i := 1000; i < 2000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%05d", i), "again"))
+	}
+	_, err := c.del("k03999")
+	assert.NoError(t, err)
+	checkTree(t, c)
+
+	// everything, only the sentinel is left
+	assert.Equal(t, uint64(len(c.ref)), c.delRange("", ""))
+	checkTree(t, c)
+}
+
+func TestDeleteRangeRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for _, compress := range []bool{false, true} {
+		c := newC()
+		c.tree.SetCompress(compress)
+		for _, i := range r.Perm(10000) {
+			assert.NoError(t, c.add(fmt.Sprintf("user:%08d", i), strings.Repeat("v", i%50)))
+		}
+		for n := 0; n < 30; n++ {
+			a, b := r.Intn(10000), r.Intn(10000)
+			c.delRange(fmt.Sprintf("user:%08d", min(a, b)), fmt.Sprintf("user:%08d", max(a, b)))
+			for j := 0; j < 100; j++ {
+				i := r.Intn(10000)
+				assert.NoError(t, c.add(fmt.Sprintf("user:%08d", i), "x"))
+			}
+		}
+		checkTree(t, c)
+	}
+}
+
+// Pages under ptr, overflow pages included
+func countPages(tree *BTree, ptr uint64) int {
+	node := tree.getNode(ptr)
+	count := 1
+	for i := uint16(0); i < node.nKeys(); i++ {
+		if node.bType() == BNODE_NODE {
+			count += countPages(tree, node.getPtr(i))
+			continue
+		}
+		for ovf := node.getPtr(i); ovf != 0; ovf = ONode(tree.get(ovf)).getNext() {
+			count++
+		}
+		if key := node.getKey(i); keySpilled(key) {
+			count += (len(keyFull(tree, key)) - BTREE_KEY_PREFIX + OVERFLOW_CAP - 1) / OVERFLOW_CAP
+		}
+	}
+	return count
+}
+
+// Every page of the deleted keys is given back
+func TestDeleteRangeFrees(t *testing.T) {
+	c := newC()
+	c.tree.SetLongKeys(true)
+	long := strings.Repeat("k", 1500)
+	kvs := func(yield func([]byte, []byte) bool) {
+		for i := 0; i < 2000; i++ {
+			val := strings.Repeat("v", i%7*1000)
+			if !yield([]byte(fmt.Sprintf("%s%04d", long, i)), []byte(val)) {
+				return
+			}
+		}
+	}
+	assert.NoError(t, c.tree.BulkLoad(kvs, 1))
+	assert.Equal(t, len(c.pages), countPages(&c.tree, c.tree.root))
+
+	for k, v := range kvs {
+		c.ref[string(k)] = string(v)
+	}
+	assert.Equal(t, uint64(500), c.delRange(long+"0500", long+"1000"))
+	checkTree(t, c)
+	assert.Equal(t, len(c.pages), countPages(&c.tree, c.tree.root))
+
+	assert.Equal(t, uint64(1500), c.delRange("", ""))
+	checkTree(t, c)
+	assert.Equal(t, 1, len(c.pages))
+}
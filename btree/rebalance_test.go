@@ -0,0 +1,109 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Smallest page bytes of the nodes under ptr, the node at ptr itself is not counted
+func minKidBytes(tree *BTree, ptr uint64) int {
+	node := tree.getNode(ptr)
+	least := tree.PageSize()
+	if node.bType() == BNODE_LEAF {
+		return least
+	}
+	for i := uint16(0); i < node.nKeys(); i++ {
+		kid := tree.getNode(node.getPtr(i))
+		least = min(least, tree.pageBytes(kid), minKidBytes(tree, node.getPtr(i)))
+	}
+	return least
+}
+
+func TestNodeSplitEven(t *testing.T) {
+	tree := &BTree{}
+	node := tree.nodeBuf(2 * BTREE_PAGE_SIZE)
+	node.setHeader(BNODE_LEAF, 30)
+	for i := uint16(0); i < 30; i++ {
+		nodeAppendKV(node, i, 0, []byte(fmt.Sprintf("k%02d", i)), []byte(strings.Repeat("v", 100)))
+	}
+	left, right := tree.nodeBuf(node.nBytes()), tree.nodeBuf(node.nBytes())
+	nodeSplitEven(tree, left, right, node)
+	assert.Equal(t, uint16(15), left.nKeys())
+	assert.Equal(t, uint16(15), right.nKeys())
+	assert.Equal(t, []byte("k15"), right.getKey(0))
+
+	// a large KV on one side
+	node.setHeader(BNODE_LEAF, 10)
+	for i := uint16(0); i < 10; i++ {
+		val := strings.Repeat("v", 100)
+		if i == 9 {
+			val = strings.Repeat("v", 900)
+		}
+		nodeAppendKV(node, i, 0, []byte(fmt.Sprintf("k%02d", i)), []byte(val))
+	}
+	nodeSplitEven(tree, left, right, node)
+	assert.Equal(t, uint16(8), left.nKeys())
+	assert.Equal(t, uint16(2), right.nKeys())
+}
+
+func TestMinFill(t *testing.T) {
+	tree := &BTree{}
+	assert.Equal(t, BTREE_MIN_FILL, tree.MinFill())
+	assert.Error(t, CheckMinFill(0))
+	assert.Error(t, CheckMinFill(0.6))
+	assert.NoError(t, CheckMinFill(0.5))
+	assert.Panics(t, func() { tree.SetMinFill(1) })
+
+	r := rand.New(rand.NewSource(3))
+	for _, fill := range []float64{0.25, 0.4, 0.5} {
+		for _, compress := range []bool{false, true} {
+			c := newC()
+			c.tree.SetMinFill(fill)
+			c.tree.SetCompress(compress)
+			for _, i := range r.Perm(3000) {
+				assert.NoError(t, c.add(fmt.Sprintf("key%08d", i), strings.Repeat("v", i%80)))
+			}
+			// deleting most keys leaves every node underfull without rebalancing
+			for _, i := range r.Perm(3000)[:2500] {
+				_, err := c.del(fmt.Sprintf("key%08d", i))
+				assert.NoError(t, err)
+			}
+			checkTree(t, c)
+			assert.Equal(t, BNODE_NODE, c.tree.getNode(c.tree.root).bType())
+			assert.Greater(t, minKidBytes(&c.tree, c.tree.root), c.tree.minFillBytes())
+		}
+	}
+}
+
+// A kid that can not be merged borrows from its sibling
+func TestDeleteBorrow(t *testing.T) {
+	c := newC()
+	// full leaves
+	assert.NoError(t, c.tree.BulkLoad(bulkKVs(1000), 1))
+	for k, v := range bulkKVs(1000) {
+		c.ref[string(k)] = string(v)
+	}
+	root := c.tree.getNode(c.tree.root)
+	nkids := root.nKeys()
+	assert.Greater(t, nkids, uint16(3))
+
+	// all but a few keys of the second leaf
+	mid := c.tree.getNode(root.getPtr(1))
+	for i := uint16(0); i+3 < mid.nKeys(); i++ {
+		_, err := c.del(string(mid.getKey(i)))
+		assert.NoError(t, err)
+	}
+	checkTree(t, c)
+	root = c.tree.getNode(c.tree.root)
+	assert.Equal(t, nkids, root.nKeys())
+	assert.Greater(t, minKidBytes(&c.tree, c.tree.root), c.tree.minFillBytes())
+
+	// ranges leave no underfull kids behind either
+	c.delRange(string(root.getKey(2)), string(root.getKey(3)))
+	checkTree(t, c)
+	assert.Greater(t, minKidBytes(&c.tree, c.tree.root), c.tree.minFillBytes())
+}
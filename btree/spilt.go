@@ -2,53 +2,133 @@ package btree
 
 import "github.com/Manik-Jasrai/ByteStore.git/utils"
 
-func NodeSplit2(left BNode, right BNode, old BNode) {
+// Decides how many keys of an oversized node go to the left node
+// NodeSplit2 moves the split from there until both nodes fit in a page
+type SplitPolicy interface {
+	// appended is whether the node grew at the right end of the tree
+	// the result is kept in [1, nkeys-1]
+	SplitAt(nkeys uint16, appended bool) uint16
+}
+
+// Fraction of the keys the default policy keeps on the left of an append
+const BTREE_APPEND_FILL = 0.9
+
+// Splits in the middle
+var EvenSplit SplitPolicy = evenSplit{}
+
+type evenSplit struct{}
+
+func (evenSplit) SplitAt(nkeys uint16, appended bool) uint16 {
+	return nkeys / 2
+}
+
+// Keeps fill of the keys on the left when the tree grows at its right end
+// increasing keys then leave full nodes behind instead of half empty ones
+// with fill 1 the right node starts with only the new key, other splits are even
+func AppendSplit(fill float64) SplitPolicy {
+	utils.Assert(fill >= 0.5 && fill <= 1, "Bad Append Fill")
+	return appendSplit{fill: fill}
+}
+
+type appendSplit struct {
+	fill float64
+}
+
+func (s appendSplit) SplitAt(nkeys uint16, appended bool) uint16 {
+	if !appended {
+		return nkeys / 2
+	}
+	return uint16(s.fill * float64(nkeys))
+}
+
+var defaultSplit = AppendSplit(BTREE_APPEND_FILL)
+
+// nil is AppendSplit(BTREE_APPEND_FILL)
+func (tree *BTree) SetSplitPolicy(policy SplitPolicy) {
+	tree.split = policy
+}
+
+func (tree *BTree) splitPolicy() SplitPolicy {
+	if tree.split == nil {
+		return defaultSplit
+	}
+	return tree.split
+}
+
+// appended is whether old grew at the right end of the tree, see SplitPolicy
+func NodeSplit2(tree *BTree, left BNode, right BNode, old BNode, appended bool) {
 	utils.Assert(old.nKeys() >= 2, "Too short to split : NodeSplit2")
 	// initial guess
-	nleft := old.nKeys() / 2
+	nleft := min(max(tree.splitPolicy().SplitAt(old.nKeys(), appended), 1), old.nKeys()-1)
 	// try to fit left
-	left_bytes := func() uint16 {
-		return 4 + 8*nleft + 2*nleft + old.getOffset(nleft)
+	left_bytes := func() int {
+		return tree.rangeBytes(old, 0, nleft)
 	}
-	for left_bytes() > BTREE_PAGE_SIZE {
+	for left_bytes() > tree.PageSize() {
 		nleft--
 	}
 	utils.Assert(nleft >= 1, "Empty Node Not Possible")
 	// try to fit right
-	right_bytes := func() uint16 {
-		return old.nBytes() - left_bytes() + uint16(4)
+	right_bytes := func() int {
+		return tree.rangeBytes(old, nleft, old.nKeys())
 	}
 
-	for right_bytes() > BTREE_PAGE_SIZE {
+	for right_bytes() > tree.PageSize() {
 		nleft++
 	}
 	utils.Assert(nleft < old.nKeys(), "")
 	nright := old.nKeys() - nleft
-	left.setHeader(old.bType(), nleft)
-	right.setHeader(old.bType(), nright)
+	left.setHeader(old.kind(), nleft)
+	right.setHeader(old.kind(), nright)
 	nodeAppendRange(left, old, 0, 0, nleft)
 	nodeAppendRange(right, old, 0, nleft, nright)
 	// the left may still be bigger
-	utils.Assert(right.nBytes() <= BTREE_PAGE_SIZE, "Not Good")
+	utils.Assert(tree.pageBytes(right) <= tree.PageSize(), "Not Good")
 }
 
-func NodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nBytes() <= BTREE_PAGE_SIZE {
-		old = old[:BTREE_PAGE_SIZE]
+// Nodes are only trimmed to a page when they are written
+// a compressed node can be larger than a page in memory
+func NodeSplit3(tree *BTree, old BNode, appended bool) (uint16, [3]BNode) {
+	if tree.pageBytes(old) <= tree.PageSize() {
 		return 1, [3]BNode{old} // not split
 	}
 
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
-	right := BNode(make([]byte, BTREE_PAGE_SIZE))
-	NodeSplit2(left, right, old)
-	if left.nBytes() <= BTREE_PAGE_SIZE {
-		left = left[:BTREE_PAGE_SIZE]
+	left := BNode(make([]byte, len(old)))
+	right := BNode(make([]byte, len(old)))
+	NodeSplit2(tree, left, right, old, appended)
+	if tree.pageBytes(left) <= tree.PageSize() {
 		return 2, [3]BNode{left, right}
 	}
 
-	leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
-	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-	NodeSplit2(leftleft, middle, left)
-	utils.Assert(leftleft.nBytes() <= BTREE_PAGE_SIZE, "Oversized data")
+	leftleft := BNode(make([]byte, len(left)))
+	middle := BNode(make([]byte, len(left)))
+	NodeSplit2(tree, leftleft, middle, left, appended)
+	utils.Assert(tree.pageBytes(leftleft) <= tree.PageSize(), "Oversized data")
 	return 3, [3]BNode{leftleft, middle, right}
 }
+
+// Splits old into two nodes that take about the same bytes in a page
+// unlike NodeSplit2 neither has to fit, the caller checks
+func nodeSplitEven(tree *BTree, left BNode, right BNode, old BNode) {
+	utils.Assert(old.nKeys() >= 2, "Too short to split : nodeSplitEven")
+	// the smallest nleft with the left at least as large as the right
+	lo, hi := uint16(1), old.nKeys()-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if tree.rangeBytes(old, 0, mid) >= tree.rangeBytes(old, mid, old.nKeys()) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	nleft := lo
+	// one less may be closer
+	if nleft > 1 && tree.rangeBytes(old, 0, nleft) > tree.rangeBytes(old, nleft-1, old.nKeys()) {
+		nleft--
+	}
+	nright := old.nKeys() - nleft
+	left.setHeader(old.kind(), nleft)
+	right.setHeader(old.kind(), nright)
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
+}
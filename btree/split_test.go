@@ -2,6 +2,7 @@ package btree
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -21,11 +22,11 @@ func TestNodeSplit2(t *testing.T) {
 		left := BNode(make([]byte, BTREE_PAGE_SIZE))
 		right := BNode(make([]byte, BTREE_PAGE_SIZE))
 
-		NodeSplit2(left, right, old)
+		NodeSplit2(&BTree{}, left, right, old, false)
 
 		assert.GreaterOrEqual(t, left.nKeys()+right.nKeys(), uint16(4))
-		assert.LessOrEqual(t, left.nBytes(), uint16(BTREE_PAGE_SIZE))
-		assert.LessOrEqual(t, right.nBytes(), uint16(BTREE_PAGE_SIZE))
+		assert.LessOrEqual(t, left.nBytes(), BTREE_PAGE_SIZE)
+		assert.LessOrEqual(t, right.nBytes(), BTREE_PAGE_SIZE)
 
 		// All keys should still be in order
 		var allKeys [][]byte
@@ -53,11 +54,11 @@ func TestNodeSplit2(t *testing.T) {
 		left := BNode(make([]byte, BTREE_PAGE_SIZE))
 		right := BNode(make([]byte, BTREE_PAGE_SIZE))
 
-		NodeSplit2(left, right, old)
+		NodeSplit2(&BTree{}, left, right, old, false)
 
 		assert.Equal(t, left.nKeys()+right.nKeys(), uint16(2))
-		assert.LessOrEqual(t, left.nBytes(), uint16(BTREE_PAGE_SIZE))
-		assert.LessOrEqual(t, right.nBytes(), uint16(BTREE_PAGE_SIZE))
+		assert.LessOrEqual(t, left.nBytes(), BTREE_PAGE_SIZE)
+		assert.LessOrEqual(t, right.nBytes(), BTREE_PAGE_SIZE)
 	}
 }
 
@@ -71,7 +72,7 @@ func TestNodeSplit3(t *testing.T) {
 			vals = append(vals, []byte("val"))
 		}
 		old := CreateLeafwithKVs(keys, vals)
-		count, nodes := NodeSplit3(old)
+		count, nodes := NodeSplit3(&BTree{}, old, false)
 
 		assert.Equal(t, uint16(1), count)
 		assert.Equal(t, uint16(5), nodes[0].nKeys())
@@ -87,11 +88,11 @@ func TestNodeSplit3(t *testing.T) {
 		}
 		old := CreateLeafwithKVs(keys, vals)
 
-		count, nodes := NodeSplit3(old)
+		count, nodes := NodeSplit3(&BTree{}, old, false)
 
 		assert.Equal(t, uint16(2), count)
-		assert.LessOrEqual(t, nodes[0].nBytes(), uint16(BTREE_PAGE_SIZE))
-		assert.LessOrEqual(t, nodes[1].nBytes(), uint16(BTREE_PAGE_SIZE))
+		assert.LessOrEqual(t, nodes[0].nBytes(), BTREE_PAGE_SIZE)
+		assert.LessOrEqual(t, nodes[1].nBytes(), BTREE_PAGE_SIZE)
 
 		// Keys should be intact and ordered
 		var allKeys [][]byte
@@ -115,7 +116,7 @@ func TestNodeSplit3(t *testing.T) {
 		}
 		old := CreateLeafwithKVs(keys, vals)
 
-		count, nodes := NodeSplit3(old)
+		count, nodes := NodeSplit3(&BTree{}, old, false)
 
 		assert.Equal(t, uint16(3), count)
 		var allKeys [][]byte
@@ -126,7 +127,7 @@ func TestNodeSplit3(t *testing.T) {
 			for j := uint16(0); j < node.nKeys(); j++ {
 				allKeys = append(allKeys, node.getKey(j))
 			}
-			assert.LessOrEqual(t, node.nBytes(), uint16(BTREE_PAGE_SIZE))
+			assert.LessOrEqual(t, node.nBytes(), BTREE_PAGE_SIZE)
 		}
 		assert.Equal(t, uint16(71), totalKeys)
 		for i := uint16(0); i < totalKeys; i++ {
@@ -134,3 +135,67 @@ func TestNodeSplit3(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitPolicy(t *testing.T) {
+	assert.Equal(t, uint16(5), EvenSplit.SplitAt(10, true))
+	assert.Equal(t, uint16(5), AppendSplit(0.9).SplitAt(10, false))
+	assert.Equal(t, uint16(9), AppendSplit(0.9).SplitAt(10, true))
+	assert.Equal(t, uint16(10), AppendSplit(1).SplitAt(10, true))
+	assert.Panics(t, func() { AppendSplit(0.2) })
+
+	// the guess of the policy is kept in range
+	var keys, vals [][]byte
+	for i := 0; i < 10; i++ {
+		keys = append(keys, []byte{byte('a' + i)})
+		vals = append(vals, bytes.Repeat([]byte{'x'}, 100))
+	}
+	old := CreateLeafwithKVs(keys, vals)
+	left := BNode(make([]byte, BTREE_PAGE_SIZE))
+	right := BNode(make([]byte, BTREE_PAGE_SIZE))
+	NodeSplit2(&BTree{split: AppendSplit(1)}, left, right, old, true)
+	assert.Equal(t, uint16(9), left.nKeys())
+	assert.Equal(t, uint16(1), right.nKeys())
+}
+
+// Leaves under ptr and how full they are on average
+func leafFill(tree *BTree, ptr uint64) (int, float64) {
+	node := tree.getNode(ptr)
+	if node.bType() == BNODE_LEAF {
+		return 1, float64(tree.pageBytes(node)) / float64(tree.PageSize())
+	}
+	n, fill := 0, 0.0
+	for i := uint16(0); i < node.nKeys(); i++ {
+		kn, kfill := leafFill(tree, node.getPtr(i))
+		n, fill = n+kn, fill+kfill*float64(kn)
+	}
+	return n, fill / float64(n)
+}
+
+func TestSplitAppend(t *testing.T) {
+	leaves := map[SplitPolicy]int{}
+	for _, policy := range []SplitPolicy{EvenSplit, nil, AppendSplit(1)} {
+		c := newC()
+		c.tree.SetSplitPolicy(policy)
+		for i := 0; i < 20000; i++ {
+			assert.NoError(t, c.add(fmt.Sprintf("ts:%010d", i), "event"))
+		}
+		checkTree(t, c)
+		n, fill := leafFill(&c.tree, c.tree.root)
+		leaves[policy] = n
+		if policy == EvenSplit {
+			assert.Less(t, fill, 0.6)
+		} else {
+			assert.Greater(t, fill, 0.85)
+		}
+	}
+	assert.Less(t, leaves[nil], leaves[EvenSplit]*6/10)
+	assert.Less(t, leaves[AppendSplit(1)], leaves[nil])
+
+	// inserts in the middle are still split evenly
+	c := newC()
+	for i := 0; i < 20000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("ts:%010d", 20000-i), "event"))
+	}
+	_, fill := leafFill(&c.tree, c.tree.root)
+	assert.Less(t, fill, 0.6)
+}
@@ -0,0 +1,110 @@
+package btree
+
+import (
+	"github.com/Manik-Jasrai/ByteStore.git/utils"
+)
+
+// Where the pages of a tree live
+// a page is not changed once it is stored, the tree writes a new one instead
+type PageStore interface {
+	// Page at ptr, it panics with *ErrCorrupt if it can not be read
+	Get(ptr uint64) []byte
+	// Stores a page and returns its pointer, never 0
+	New(page []byte) uint64
+	// The page is no longer used by the tree
+	Del(ptr uint64)
+}
+
+// Storage of the pages, it has to be set before the tree is used
+func (tree *BTree) SetStore(store PageStore) {
+	tree.store = store
+}
+
+func (tree *BTree) Store() PageStore {
+	return tree.store
+}
+
+func (tree *BTree) get(ptr uint64) []byte {
+	return tree.store.Get(ptr)
+}
+func (tree *BTree) new(page []byte) uint64 {
+	return tree.store.New(page)
+}
+func (tree *BTree) del(ptr uint64) {
+	tree.store.Del(ptr)
+}
+
+// Pages kept in memory, pointers count up from 1
+type MemStore struct {
+	pages map[uint64]BNode
+	last  uint64
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{pages: map[uint64]BNode{}}
+}
+
+func (store *MemStore) Get(ptr uint64) []byte {
+	page, ok := store.pages[ptr]
+	if !ok {
+		panic(&ErrCorrupt{Page: ptr, Reason: "no such page"})
+	}
+	return page
+}
+
+func (store *MemStore) New(page []byte) uint64 {
+	store.last++
+	store.pages[store.last] = page
+	return store.last
+}
+
+func (store *MemStore) Del(ptr uint64) {
+	_, ok := store.pages[ptr]
+	utils.Assert(ok, "Node Exists")
+	delete(store.pages, ptr)
+}
+
+// Number of pages in use
+func (store *MemStore) Len() int {
+	return len(store.pages)
+}
+
+// Counts the calls to another store
+type CountingStore struct {
+	PageStore
+	Gets int
+	News int
+	Dels int
+}
+
+func (store *CountingStore) Get(ptr uint64) []byte {
+	store.Gets++
+	return store.PageStore.Get(ptr)
+}
+
+func (store *CountingStore) New(page []byte) uint64 {
+	store.News++
+	return store.PageStore.New(page)
+}
+
+func (store *CountingStore) Del(ptr uint64) {
+	store.Dels++
+	store.PageStore.Del(ptr)
+}
+
+// Records the pages an update writes and holds back the ones it frees, see atomic
+type atomicStore struct {
+	PageStore
+	written []uint64
+	freed   []uint64
+}
+
+func (store *atomicStore) New(page []byte) uint64 {
+	ptr := store.PageStore.New(page)
+	store.written = append(store.written, ptr)
+	return ptr
+}
+
+func (store *atomicStore) Del(ptr uint64) {
+	store.freed = append(store.freed, ptr)
+}
@@ -0,0 +1,74 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemStore(t *testing.T) {
+	store := NewMemStore()
+	a := store.New([]byte("a"))
+	b := store.New([]byte("b"))
+	assert.NotEqual(t, uint64(0), a)
+	assert.NotEqual(t, a, b)
+	assert.Equal(t, []byte("b"), store.Get(b))
+	store.Del(a)
+	assert.Equal(t, 1, store.Len())
+	assert.PanicsWithError(t, (&ErrCorrupt{Page: a, Reason: "no such page"}).Error(), func() { store.Get(a) })
+
+	// a tree hosted on it
+	tree := BTree{}
+	tree.SetStore(store)
+	assert.NoError(t, tree.Insert([]byte("k"), []byte("v")))
+	val, err := tree.Get([]byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), val)
+}
+
+func TestCountingStore(t *testing.T) {
+	c := newC()
+	for i := 0; i < 2000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%05d", i), strings.Repeat("v", 50)))
+	}
+	depth := leafDepth(&c.tree, c.tree.root)
+	counting := &CountingStore{PageStore: c.tree.Store()}
+	c.tree.SetStore(counting)
+
+	assert.Equal(t, []byte(strings.Repeat("v", 50)), c.get([]byte("k01000")))
+	assert.Equal(t, depth, counting.Gets)
+	assert.Equal(t, 0, counting.News+counting.Dels)
+
+	// the path is rewritten and the old one given back
+	assert.NoError(t, c.add("k01000", "x"))
+	assert.Equal(t, counting.News, counting.Dels)
+	assert.Equal(t, depth, counting.News)
+}
+
+// Pages the tree can reach
+func reachable(t *testing.T, c *C) int {
+	var buf bytes.Buffer
+	assert.NoError(t, c.tree.Dump(&buf, DUMP_JSON))
+	return strings.Count(buf.String(), `"ptr"`)
+}
+
+func TestStoreNoLeak(t *testing.T) {
+	c := newC()
+	r := rand.New(rand.NewSource(5))
+	for _, i := range r.Perm(3000) {
+		assert.NoError(t, c.add(fmt.Sprintf("k%05d", i), strings.Repeat("v", i%9*500)))
+	}
+	assert.Equal(t, reachable(t, c), len(c.pages))
+	for _, i := range r.Perm(3000)[:1500] {
+		_, err := c.del(fmt.Sprintf("k%05d", i))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, reachable(t, c), len(c.pages))
+	_, err := c.tree.DeleteRange([]byte("k00500"), []byte("k02500"))
+	assert.NoError(t, err)
+	assert.Equal(t, reachable(t, c), len(c.pages))
+}
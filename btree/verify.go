@@ -0,0 +1,317 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Kinds of problems Verify reports
+const (
+	VIOLATION_BAD_PAGE    = 1  // null pointer or a page that can not be decoded
+	VIOLATION_BAD_TYPE    = 2  // unknown node type or format
+	VIOLATION_BAD_SIZE    = 3  // content past the end of the page
+	VIOLATION_SHARED_PAGE = 4  // page reachable more than once
+	VIOLATION_EMPTY       = 5  // node without keys
+	VIOLATION_KEY_ORDER   = 6  // keys out of order or out of the range of the parent
+	VIOLATION_SEPARATOR   = 7  // key in the parent does not match the first key of the kid
+	VIOLATION_DEPTH       = 8  // leaves at different depths
+	VIOLATION_COUNT       = 9  // stored subtree count does not match
+	VIOLATION_OVERFLOW    = 10 // broken chain of overflow pages
+	VIOLATION_FENCE       = 11 // high fence of a leaf out of the range of its keys and the next separator
+)
+
+type Violation struct {
+	Kind int
+	Ptr  uint64 // page with the problem
+	Idx  int    // key in the page, -1 for the page as a whole
+	Msg  string
+}
+
+func (v Violation) Error() string {
+	if v.Idx < 0 {
+		return fmt.Sprintf("page %d: %s", v.Ptr, v.Msg)
+	}
+	return fmt.Sprintf("page %d key %d: %s", v.Ptr, v.Idx, v.Msg)
+}
+
+// Walks every page reachable from the root and returns what is wrong with them
+// an empty result means the tree is sound, a page that can not be read is not descended into
+func (tree *BTree) Verify() []Violation {
+	if tree.root == 0 {
+		return nil
+	}
+	v := &verifier{tree: tree, seen: map[uint64]bool{tree.root: true}}
+	v.node(tree.root, nil, nil, 1)
+	return v.out
+}
+
+type verifier struct {
+	tree  *BTree
+	seen  map[uint64]bool
+	depth int // of the leaves, 0 until one is found
+	out   []Violation
+}
+
+func (v *verifier) report(kind int, ptr uint64, idx int, format string, args ...any) {
+	v.out = append(v.out, Violation{Kind: kind, Ptr: ptr, Idx: idx, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Marks a page as reached, false if it was reached before
+func (v *verifier) visit(ptr uint64, idx int, from uint64) bool {
+	if ptr == 0 {
+		v.report(VIOLATION_BAD_PAGE, from, idx, "null pointer")
+		return false
+	}
+	if v.seen[ptr] {
+		v.report(VIOLATION_SHARED_PAGE, from, idx, "page %d is already reachable", ptr)
+		return false
+	}
+	v.seen[ptr] = true
+	return true
+}
+
+// Checks the node at ptr and everything under it
+// its keys have to be in [lo, hi), a nil lo is the left edge of the tree, where the sentinel is
+// returns the node and the number of keys under it, an empty node if it can not be read
+func (v *verifier) node(ptr uint64, lo []byte, hi []byte, depth int) (node BNode, count uint64) {
+	// only a corrupt page is a violation, any other panic is a bug and is passed on, see corruptFrom
+	defer func() {
+		if e := corruptFrom(recover()); e != nil {
+			v.report(VIOLATION_BAD_PAGE, ptr, -1, "unreadable: %v", e)
+			node, count = BNode{}, 0
+		}
+	}()
+	tree := v.tree
+
+	if !v.checkPage(ptr) {
+		return BNode{}, 0
+	}
+	node = tree.getNode(ptr)
+	if node.nKeys() == 0 {
+		v.report(VIOLATION_EMPTY, ptr, -1, "no keys")
+		return node, 0
+	}
+
+	// keys in order and inside the range of the parent
+	for i := uint16(0); i < node.nKeys(); i++ {
+		key := node.getKey(i)
+		switch {
+		case i == 0 && lo == nil:
+			if len(key) != 0 {
+				v.report(VIOLATION_KEY_ORDER, ptr, 0, "first key of the left edge is not the sentinel")
+			}
+		case i == 0:
+			if len(key) == 0 || v.compare(key, lo) < 0 {
+				v.report(VIOLATION_KEY_ORDER, ptr, 0, "first key is below the separator")
+			}
+		case i == 1 && lo == nil:
+			// the sentinel is below any key whatever the comparator says
+		default:
+			if v.compare(node.getKey(i-1), key) >= 0 {
+				v.report(VIOLATION_KEY_ORDER, ptr, int(i), "key is not above the previous one")
+			}
+		}
+	}
+	if last := node.getKey(node.nKeys() - 1); hi != nil && v.compare(last, hi) >= 0 {
+		v.report(VIOLATION_KEY_ORDER, ptr, int(node.nKeys()-1), "last key is not below the next separator")
+	}
+
+	if node.bType() == BNODE_LEAF {
+		if v.depth == 0 {
+			v.depth = depth
+		} else if v.depth != depth {
+			v.report(VIOLATION_DEPTH, ptr, -1, "leaf at depth %d, others at %d", depth, v.depth)
+		}
+		for i := uint16(0); i < node.nKeys(); i++ {
+			v.leafKV(ptr, node, i)
+		}
+		v.fence(ptr, node, hi)
+		return node, uint64(node.nKeys())
+	}
+
+	for i := uint16(0); i < node.nKeys(); i++ {
+		kptr := node.getPtr(i)
+		if !v.visit(kptr, int(i), ptr) {
+			continue
+		}
+		klo, khi := node.getKey(i), hi
+		if i == 0 {
+			klo = lo
+		}
+		if i+1 < node.nKeys() {
+			khi = node.getKey(i + 1)
+		}
+		kid, n := v.node(kptr, klo, khi, depth+1)
+		count += n
+		if len(kid) == 0 || kid.nKeys() == 0 {
+			continue
+		}
+		if !v.separates(node.getKey(i), kid.getKey(0)) {
+			v.report(VIOLATION_SEPARATOR, ptr, int(i), "separator does not match the first key of page %d", kptr)
+		}
+		switch val := node.getValue(i); len(val) {
+		case 0: // no count, see countVal
+		case 8:
+			if stored := binary.LittleEndian.Uint64(val); stored != n {
+				v.report(VIOLATION_COUNT, ptr, int(i), "count is %d, page %d has %d keys", stored, kptr, n)
+			}
+		default:
+			v.report(VIOLATION_COUNT, ptr, int(i), "count of %d bytes", len(val))
+		}
+	}
+	return node, count
+}
+
+// Checks the raw page before it is decoded
+func (v *verifier) checkPage(ptr uint64) bool {
+	if kind, idx, reason := v.tree.pageProblem(v.tree.get(ptr)); kind != 0 {
+		v.report(kind, ptr, idx, "%s", reason)
+		return false
+	}
+	return true
+}
+
+// What is wrong with a node page, a 0 kind if it can be decoded
+// idx is the key with the problem, -1 for the page as a whole
+func (tree *BTree) pageProblem(page BNode) (kind int, idx int, reason string) {
+	if len(page) != tree.PageSize() {
+		return VIOLATION_BAD_SIZE, -1, fmt.Sprintf("page of %d bytes", len(page))
+	}
+	if btype := page.bType(); btype != BNODE_LEAF && btype != BNODE_NODE {
+		return VIOLATION_BAD_TYPE, -1, fmt.Sprintf("node type %d", btype)
+	}
+	if format := page.format(); format != BNODE_FORMAT_PLAIN && format != BNODE_FORMAT_PREFIX {
+		return VIOLATION_BAD_TYPE, -1, fmt.Sprintf("node format %d", format)
+	}
+	if page.wide() != tree.wide() {
+		return VIOLATION_BAD_TYPE, -1, "offset width does not match the page size"
+	}
+	// every node has a key, the leftmost leaf has the sentinel
+	if page.nKeys() == 0 {
+		return VIOLATION_BAD_SIZE, -1, "no keys"
+	}
+	if HEADER+(8+page.offsetSize())*int(page.nKeys()) > len(page) || page.nBytes() > len(page) {
+		return VIOLATION_BAD_SIZE, -1, fmt.Sprintf("%d keys do not fit in the page", page.nKeys())
+	}
+	if reason := fenceProblem(page); reason != "" {
+		return VIOLATION_BAD_SIZE, -1, reason
+	}
+	for i := uint16(0); i < page.nKeys(); i++ {
+		if page.getOffset(i) > page.getOffset(i+1) {
+			return VIOLATION_BAD_SIZE, int(i), "offsets out of order"
+		}
+	}
+	if page.format() == BNODE_FORMAT_PREFIX {
+		return tree.prefixProblem(page)
+	}
+	for i := uint16(0); i < page.nKeys(); i++ {
+		pos, size := page.KVPos(i), page.getOffset(i+1)-page.getOffset(i)
+		if size < 4 {
+			return VIOLATION_BAD_SIZE, int(i), "key-value of less than 4 bytes"
+		}
+		klen := int(binary.LittleEndian.Uint16(page[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(page[pos+2:]))
+		if 4+klen+vlen != size {
+			return VIOLATION_BAD_SIZE, int(i), fmt.Sprintf("key of %d and value of %d bytes in %d bytes", klen, vlen, size)
+		}
+	}
+	return 0, -1, ""
+}
+
+// What is wrong with the key-values of a prefix compressed page, see pageProblem
+// the keys are rebuilt from the previous ones, so they have to fit once decompressed too
+func (tree *BTree) prefixProblem(page BNode) (kind int, idx int, reason string) {
+	total := HEADER + (8+page.offsetSize())*int(page.nKeys())
+	prev := 0 // length of the previous key
+	for i := uint16(0); i < page.nKeys(); i++ {
+		pos, size := page.KVPos(i), page.getOffset(i+1)-page.getOffset(i)
+		if size < 6 {
+			return VIOLATION_BAD_SIZE, int(i), "key-value of less than 6 bytes"
+		}
+		shared := int(binary.LittleEndian.Uint16(page[pos:]))
+		slen := int(binary.LittleEndian.Uint16(page[pos+2:]))
+		vlen := int(binary.LittleEndian.Uint16(page[pos+4:]))
+		if 6+slen+vlen != size {
+			return VIOLATION_BAD_SIZE, int(i), fmt.Sprintf("suffix of %d and value of %d bytes in %d bytes", slen, vlen, size)
+		}
+		if shared > prev {
+			return VIOLATION_BAD_SIZE, int(i), fmt.Sprintf("key shares %d bytes of a key of %d", shared, prev)
+		}
+		prev = shared + slen
+		total += 4 + prev + vlen
+		if prev > 0xffff || total > tree.maxNodeSize() {
+			return VIOLATION_BAD_SIZE, int(i), "keys too large once decompressed"
+		}
+	}
+	return 0, -1, ""
+}
+
+// Checks the high fence of a leaf against its keys and hi, the next separator, see leafFence
+func (v *verifier) fence(ptr uint64, node BNode, hi []byte) {
+	fence, ok := leafFence(v.tree.get(ptr))
+	last := node.getKey(node.nKeys() - 1)
+	switch {
+	case !ok:
+	case fence == nil:
+		if hi != nil {
+			v.report(VIOLATION_FENCE, ptr, -1, "no high fence, but the leaf is not the last one")
+		}
+	case len(last) > 0 && v.compare(last, fence) >= 0: // the sentinel is below any key
+		v.report(VIOLATION_FENCE, ptr, int(node.nKeys()-1), "last key is not below the high fence")
+	case hi != nil && v.compare(fence, hi) > 0:
+		v.report(VIOLATION_FENCE, ptr, -1, "high fence is above the next separator")
+	}
+}
+
+// Checks the overflow pages of a leaf KV
+func (v *verifier) leafKV(ptr uint64, node BNode, idx uint16) {
+	if ovf := node.getPtr(idx); ovf != 0 {
+		v.chain(ptr, idx, ovf, binary.LittleEndian.Uint64(node.getValue(idx)))
+	} else if len(node.getValue(idx)) > BTREE_MAX_VAL_SIZE {
+		v.report(VIOLATION_OVERFLOW, ptr, int(idx), "value of %d bytes is not in overflow pages", len(node.getValue(idx)))
+	}
+	if key := node.getKey(idx); keySpilled(key) {
+		tail := binary.LittleEndian.Uint64(key[BTREE_KEY_PREFIX:])
+		v.chain(ptr, idx, tail, binary.LittleEndian.Uint64(key[BTREE_KEY_PREFIX+8:]))
+	}
+}
+
+// Checks a chain of overflow pages holds size bytes
+func (v *verifier) chain(ptr uint64, idx uint16, head uint64, size uint64) {
+	total := uint64(0)
+	for ovf := head; ovf != 0; {
+		if !v.visit(ovf, int(idx), ptr) {
+			return
+		}
+		page := ONode(v.tree.get(ovf))
+		if BNode(page).bType() != BNODE_OVERFLOW {
+			v.report(VIOLATION_OVERFLOW, ptr, int(idx), "page %d in the chain is not an overflow page", ovf)
+			return
+		}
+		if OVERFLOW_HEADER+int(page.size()) > len(page) {
+			v.report(VIOLATION_BAD_SIZE, ovf, -1, "overflow page holds %d bytes", page.size())
+			return
+		}
+		total += uint64(page.size())
+		ovf = page.getNext()
+	}
+	if total != size {
+		v.report(VIOLATION_OVERFLOW, ptr, int(idx), "chain holds %d bytes instead of %d", total, size)
+	}
+}
+
+// Compares two stored keys
+func (v *verifier) compare(a []byte, b []byte) int {
+	return keyCompare(v.tree, a, keyFull(v.tree, b))
+}
+
+// Whether sep in a parent matches first, the first key of its kid
+// a compressed bytewise tree may keep a prefix of it, see keySeparator
+func (v *verifier) separates(sep []byte, first []byte) bool {
+	if bytes.Equal(sep, first) {
+		return true
+	}
+	truncated := v.tree.compress && v.tree.bytewise()
+	return truncated && !keySpilled(first) && len(sep) < len(first) && bytes.HasPrefix(first, sep)
+}
@@ -0,0 +1,177 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySound(t *testing.T) {
+	c := newC()
+	assert.Empty(t, c.tree.Verify())
+
+	r := rand.New(rand.NewSource(4))
+	for _, cmp := range []Comparator{nil, reverse{}} {
+		for _, compress := range []bool{false, true} {
+			c := newC()
+			c.tree.SetComparator(cmp)
+			c.tree.SetCompress(compress)
+			c.tree.SetLongKeys(true)
+			for _, i := range r.Perm(3000) {
+				key := fmt.Sprintf("k%06d", i)
+				if i%100 == 0 {
+					key += strings.Repeat("x", 1500) // spilled
+				}
+				assert.NoError(t, c.add(key, strings.Repeat("v", i%7*700)))
+			}
+			for _, i := range r.Perm(3000)[:2000] {
+				c.tree.Delete([]byte(fmt.Sprintf("k%06d", i)))
+			}
+			assert.Empty(t, c.tree.Verify())
+		}
+	}
+}
+
+// Tree of a root and a few leaves
+func verifyTree(t *testing.T) (*C, BNode) {
+	c := newC()
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%04d", i*10), strings.Repeat("v", 50)))
+	}
+	assert.NoError(t, c.add("big", strings.Repeat("v", 5000)))
+	assert.Empty(t, c.tree.Verify())
+	root := c.pages[c.tree.root]
+	assert.Equal(t, BNODE_NODE, root.bType())
+	assert.Greater(t, root.nKeys(), uint16(3))
+	return c, root
+}
+
+func violationKinds(out []Violation) []int {
+	kinds := []int{}
+	for _, v := range out {
+		kinds = append(kinds, v.Kind)
+	}
+	return kinds
+}
+
+func TestVerifyKeyOrder(t *testing.T) {
+	c, root := verifyTree(t)
+	leaf := c.pages[root.getPtr(1)]
+	// k... keys of the same length, swap the tens of two of them
+	a, b := leaf.getKey(2), leaf.getKey(3)
+	a[len(a)-2], b[len(b)-2] = b[len(b)-2], a[len(a)-2]
+
+	out := c.tree.Verify()
+	assert.Contains(t, violationKinds(out), VIOLATION_KEY_ORDER)
+	assert.Equal(t, root.getPtr(1), out[0].Ptr)
+	assert.Equal(t, 3, out[0].Idx)
+	assert.Contains(t, out[0].Error(), "key 3")
+}
+
+func TestVerifySeparator(t *testing.T) {
+	c, root := verifyTree(t)
+	// a smaller separator still routes every key to its kid, but does not match it
+	// k..x0 becomes k..(x-1)z, still above the last key of the kid on its left, though below its fence
+	key := root.getKey(2)
+	key[len(key)-2]--
+	key[len(key)-1] = 'z'
+	out := c.tree.Verify()
+	assert.Equal(t, []int{VIOLATION_FENCE, VIOLATION_SEPARATOR}, violationKinds(out))
+	assert.Equal(t, root.getPtr(1), out[0].Ptr)
+	assert.Equal(t, c.tree.root, out[1].Ptr)
+	assert.Equal(t, 2, out[1].Idx)
+
+	// a larger one leaves keys of the kid below it
+	key[len(key)-2] += 2
+	assert.Contains(t, violationKinds(c.tree.Verify()), VIOLATION_KEY_ORDER)
+}
+
+func TestVerifyPages(t *testing.T) {
+	c, root := verifyTree(t)
+	leaf := c.pages[root.getPtr(1)]
+	btype := leaf.bType()
+	binary.LittleEndian.PutUint16(leaf[0:], 7)
+	out := c.tree.Verify()
+	assert.Equal(t, []int{VIOLATION_BAD_TYPE}, violationKinds(out))
+	assert.Equal(t, root.getPtr(1), out[0].Ptr)
+	assert.Equal(t, -1, out[0].Idx)
+	binary.LittleEndian.PutUint16(leaf[0:], btype)
+
+	nkeys := leaf.nKeys()
+	binary.LittleEndian.PutUint16(leaf[2:], 1000)
+	assert.Contains(t, violationKinds(c.tree.Verify()), VIOLATION_BAD_SIZE)
+	binary.LittleEndian.PutUint16(leaf[2:], nkeys)
+	assert.Empty(t, c.tree.Verify())
+
+	// two links to the same leaf
+	ptr := root.getPtr(2)
+	root.setPtr(2, root.getPtr(1))
+	out = c.tree.Verify()
+	assert.Contains(t, violationKinds(out), VIOLATION_SHARED_PAGE)
+	root.setPtr(2, ptr)
+
+	root.setPtr(2, 0)
+	assert.Contains(t, violationKinds(c.tree.Verify()), VIOLATION_BAD_PAGE)
+	root.setPtr(2, 12345)
+	assert.Contains(t, violationKinds(c.tree.Verify()), VIOLATION_BAD_PAGE)
+	root.setPtr(2, ptr)
+	assert.Empty(t, c.tree.Verify())
+}
+
+func TestVerifyCounts(t *testing.T) {
+	c, root := verifyTree(t)
+	val := root.getValue(1)
+	binary.LittleEndian.PutUint64(val, binary.LittleEndian.Uint64(val)+1)
+	out := c.tree.Verify()
+	assert.Equal(t, []int{VIOLATION_COUNT}, violationKinds(out))
+	assert.Equal(t, 1, out[0].Idx)
+}
+
+func TestVerifyDepth(t *testing.T) {
+	c := newC()
+	for i := 0; i < 20000; i++ {
+		assert.NoError(t, c.add(fmt.Sprintf("k%05d", i), strings.Repeat("v", 50)))
+	}
+	root := c.pages[c.tree.root]
+	assert.Equal(t, 3, leafDepth(&c.tree, c.tree.root))
+	// the last kid of the root is replaced by its own last kid
+	last := c.pages[root.getPtr(root.nKeys()-1)]
+	c.pages[root.getPtr(root.nKeys()-1)] = c.pages[last.getPtr(last.nKeys()-1)]
+	assert.Contains(t, violationKinds(c.tree.Verify()), VIOLATION_DEPTH)
+}
+
+func TestVerifyOverflow(t *testing.T) {
+	c, _ := verifyTree(t)
+	it := c.tree.SeekGE([]byte("big"))
+	leaf, idx := it.path[len(it.path)-1], it.pos[len(it.pos)-1]
+	ovf := leaf.getPtr(idx)
+	page := ONode(c.pages[ovf])
+	page.setHeader(page.size()-1, page.getNext())
+	out := c.tree.Verify()
+	assert.Equal(t, []int{VIOLATION_OVERFLOW}, violationKinds(out))
+	assert.Equal(t, int(idx), out[0].Idx)
+}
+
+// Panics on reading one page like a bug would
+type bugStore struct {
+	PageStore
+	ptr uint64
+}
+
+func (store bugStore) Get(ptr uint64) []byte {
+	if ptr == store.ptr {
+		panic("bug")
+	}
+	return store.PageStore.Get(ptr)
+}
+
+// Only corrupt pages are violations, a bug is passed on instead of being reported as a bad page
+func TestVerifyBug(t *testing.T) {
+	c, root := verifyTree(t)
+	c.tree.SetStore(bugStore{PageStore: c.tree.Store(), ptr: root.getPtr(1)})
+	assert.PanicsWithValue(t, "bug", func() { c.tree.Verify() })
+}
@@ -0,0 +1,93 @@
+package kv
+
+import (
+	"fmt"
+	"iter"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func bulkKVs(n int) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for i := 0; i < n; i++ {
+			if !yield([]byte(fmt.Sprintf("k%05d", i)), []byte(fmt.Sprintf("v%05d", i))) {
+				return
+			}
+		}
+	}
+}
+
+// Pages of the file that are neither in the tree nor on the free list
+func leakedPages(t *testing.T, db *KV) int {
+	tx, err := db.BeginRead()
+	assert.NoError(t, err)
+	defer tx.Done()
+	free := int(db.free.tailSeq - db.free.headSeq)
+	// the meta page and the free list node, the list fits in one here
+	return int(db.page.flushed) - 2 - len(treePages(t, &tx.tree)) - free
+}
+
+func TestBulkLoad(t *testing.T) {
+	db := newKV(t, 0)
+	version := db.version
+	assert.NoError(t, db.BulkLoad(bulkKVs(5000), 1))
+	// a single commit, with nothing freed
+	assert.Equal(t, version+1, db.version)
+	assert.Equal(t, db.free.headSeq, db.free.tailSeq)
+	assert.Equal(t, 0, leakedPages(t, db))
+	assert.Empty(t, db.Verify())
+
+	db = reopen(t, db)
+	count, err := db.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5000), count)
+	val, err := db.Get([]byte("k04321"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v04321"), val)
+	assert.Empty(t, db.Verify())
+
+	// only into an empty store
+	assert.Error(t, db.BulkLoad(bulkKVs(10), 1))
+	assert.Equal(t, version+1, db.version)
+	db.Close()
+}
+
+func TestBulkLoadUnsorted(t *testing.T) {
+	db := newKV(t, 0)
+	info, err := os.Stat(db.Path)
+	assert.NoError(t, err)
+	version, flushed, free := db.version, db.page.flushed, db.free
+
+	kvs := func(yield func([]byte, []byte) bool) {
+		for k, v := range bulkKVs(5000) {
+			if !yield(k, v) {
+				return
+			}
+		}
+		yield([]byte("k00001"), nil)
+	}
+	assert.ErrorContains(t, db.BulkLoad(kvs, 1), "not sorted")
+	// nothing was written, and the pages of the load are not kept
+	assert.Equal(t, version, db.version)
+	assert.Equal(t, flushed, db.page.flushed)
+	assert.Equal(t, [4]uint64{free.headPage, free.headSeq, free.tailPage, free.tailSeq},
+		[4]uint64{db.free.headPage, db.free.headSeq, db.free.tailPage, db.free.tailSeq})
+	assert.Empty(t, db.page.temp)
+	after, err := os.Stat(db.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), after.Size())
+	_, _, err = db.First()
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// the store can still be loaded
+	assert.NoError(t, db.BulkLoad(bulkKVs(100), 1))
+	db = reopen(t, db)
+	count, err := db.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), count)
+	assert.Equal(t, 0, leakedPages(t, db))
+	assert.Empty(t, db.Verify())
+	db.Close()
+}
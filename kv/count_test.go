@@ -0,0 +1,118 @@
+package kv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func keyOf(i int) []byte {
+	return []byte(fmt.Sprintf("k%04d", i))
+}
+
+// Count, Rank and Select of a store with the keys of keys, in order
+func checkCounts(t *testing.T, db *KV, keys []int) {
+	count, err := db.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(len(keys)), count)
+	for rank, i := range keys {
+		if rank%37 != 0 {
+			continue
+		}
+		r, err := db.Rank(keyOf(i))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(rank), r)
+		// a missing key right after it
+		r, err = db.Rank(append(keyOf(i), 0))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(rank+1), r)
+		k, _, err := db.Select(uint64(rank))
+		assert.NoError(t, err)
+		assert.Equal(t, keyOf(i), k)
+		count, err := db.Count(keyOf(i), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(len(keys)-rank), count)
+	}
+	_, _, err = db.Select(uint64(len(keys)))
+	assert.ErrorIs(t, err, ErrNotFound)
+	r, err := db.Rank([]byte("z"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(len(keys)), r)
+	assert.Empty(t, db.Verify())
+}
+
+func TestCounts(t *testing.T) {
+	db := newKV(t, 1000)
+	keys := []int{}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, i)
+	}
+	checkCounts(t, db, keys)
+	count, err := db.Count(keyOf(100), keyOf(200))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), count)
+	r, err := db.Rank([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), r)
+
+	// the subtree counts are in the file
+	_, err = db.DeleteRange(keyOf(200), keyOf(400))
+	assert.NoError(t, err)
+	for i := 500; i < 600; i += 2 {
+		assert.NoError(t, db.Del(keyOf(i)))
+	}
+	db = reopen(t, db)
+	keys = keys[:0]
+	for i := 0; i < 1000; i++ {
+		if !(i >= 200 && i < 400) && !(i >= 500 && i < 600 && i%2 == 0) {
+			keys = append(keys, i)
+		}
+	}
+	checkCounts(t, db, keys)
+	db.Close()
+}
+
+// A reader counts its snapshot while a writer commits
+func TestCountsReadTx(t *testing.T) {
+	db := newKV(t, 1000)
+	defer db.Close()
+	tx, err := db.BeginRead()
+	assert.NoError(t, err)
+
+	w, err := db.Begin()
+	assert.NoError(t, err)
+	_, err = w.DeleteRange(keyOf(0), keyOf(300))
+	assert.NoError(t, err)
+	for i := 1000; i < 1100; i++ {
+		assert.NoError(t, w.Set(keyOf(i), []byte("v")))
+	}
+	assert.NoError(t, w.Commit())
+
+	count, err := tx.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1000), count)
+	r, err := tx.Rank(keyOf(500))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(500), r)
+	it := tx.Select(10)
+	assert.True(t, it.Valid())
+	k, _ := it.Deref()
+	assert.Equal(t, keyOf(10), k)
+	assert.False(t, tx.Select(1000).Valid())
+
+	count, err = db.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(800), count)
+	r, err = db.Rank(keyOf(500))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(200), r)
+	k, _, err = db.Select(10)
+	assert.NoError(t, err)
+	assert.Equal(t, keyOf(310), k)
+
+	tx.Done()
+	_, err = tx.Rank(keyOf(500))
+	assert.ErrorIs(t, err, ErrTxDone)
+	assert.False(t, tx.Select(0).Valid())
+}
@@ -0,0 +1,21 @@
+package kv
+
+import (
+	"errors"
+
+	"github.com/Manik-Jasrai/ByteStore.git/btree"
+)
+
+// Errors returned by the store, compare with errors.Is
+// the tree errors are the same values, so either package can be used
+var (
+	ErrNotFound      = btree.ErrNotFound
+	ErrKeyTooLarge   = btree.ErrKeyTooLarge
+	ErrValueTooLarge = btree.ErrValueTooLarge
+	ErrClosed        = errors.New("database is closed")
+	ErrTxDone        = errors.New("transaction is already committed or aborted")
+	ErrFormat        = errors.New("unsupported file format")
+)
+
+// A page of the file that does not make sense, see btree.ErrCorrupt
+type ErrCorrupt = btree.ErrCorrupt
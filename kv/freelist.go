@@ -1,7 +1,6 @@
 package kv
 
 import (
-	"github.com/Manik-Jasrai/ByteStore.git/btree"
 	"github.com/Manik-Jasrai/ByteStore.git/utils"
 )
 
@@ -10,12 +9,21 @@ type FreeList struct {
 	new func([]byte) uint64 // append a new page
 	set func(uint64) []byte // update an existing page
 
+	pageSize int
+
 	headPage uint64 // Pointer to head Page
 	headSeq  uint64 // Seq no of firdt item
 	tailPage uint64 // Pointer to tail Page
 	tailSeq  uint64 // Seq no of Last item
 
 	maxSeq uint64 // last item available for consumption
+	// tail once each commit a reader may still see was written, oldest first
+	commits []flCommit
+}
+
+type flCommit struct {
+	version uint64
+	seq     uint64
 }
 
 // Get 1 item from list head, return 0 on failure
@@ -31,13 +39,13 @@ func (fl *FreeList) PopHead() uint64 {
 // Add 1 item to tail
 func (fl *FreeList) PushTail(ptr uint64) {
 
-	LNode(fl.set(fl.tailPage)).setPtr(seq2idx(fl.tailSeq), ptr)
+	LNode(fl.set(fl.tailPage)).setPtr(fl.seq2idx(fl.tailSeq), ptr)
 	fl.tailSeq++
-	if seq2idx(fl.tailSeq) == 0 {
+	if fl.seq2idx(fl.tailSeq) == 0 {
 		// Add a new tail Page
 		next, head := flPop(fl)
 		if next == 0 {
-			next = fl.new(make([]byte, btree.BTREE_PAGE_SIZE))
+			next = fl.new(make([]byte, fl.pageSize))
 		}
 		LNode(fl.set(fl.tailPage)).setNext(next)
 		fl.tailPage = next
@@ -48,13 +56,23 @@ func (fl *FreeList) PushTail(ptr uint64) {
 	}
 }
 
-func seq2idx(seq uint64) int {
-	return int(seq % FREE_LIST_CAP)
+func (fl *FreeList) seq2idx(seq uint64) int {
+	return int(seq % uint64(freeListCap(fl.pageSize)))
 }
 
-// make the newly added item available for consumption
-func (fl *FreeList) SetMaxSeq() {
-	fl.maxSeq = fl.tailSeq
+// Records the items freed up to the commit of version
+func (fl *FreeList) AddCommit(version uint64) {
+	fl.commits = append(fl.commits, flCommit{version: version, seq: fl.tailSeq})
+}
+
+// make the items freed up to the commit of version available for consumption
+// the ones freed after it may still be seen by a reader of version
+func (fl *FreeList) SetMaxSeq(version uint64) {
+	for len(fl.commits) > 1 && fl.commits[1].version <= version {
+		fl.commits = fl.commits[1:]
+	}
+	utils.Assert(fl.commits[0].version <= version, "Unknown version : FreeList SetMaxSeq")
+	fl.maxSeq = fl.commits[0].seq
 }
 
 // pop the first item from the head page
@@ -65,9 +83,9 @@ func flPop(fl *FreeList) (ptr uint64, head uint64) {
 	}
 
 	node := LNode(fl.get(fl.headPage))
-	ptr = node.getPtr(seq2idx(fl.headSeq))
+	ptr = node.getPtr(fl.seq2idx(fl.headSeq))
 	fl.headSeq++
-	if seq2idx(fl.headSeq) == 0 {
+	if fl.seq2idx(fl.headSeq) == 0 {
 		// we return the previous head page to recycle it
 		head, fl.headPage = fl.headPage, node.getNext()
 		utils.Assert(fl.headPage != 0, "Empty List")
@@ -0,0 +1,72 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Manik-Jasrai/ByteStore.git/btree"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreeListReopen(t *testing.T) {
+	db := newKV(t, 0)
+	size := int64(0)
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 500; i++ {
+			assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%04d-%d", i, round))))
+		}
+		_, err := db.DeleteRange([]byte("k0100"), []byte("k0400"))
+		assert.NoError(t, err)
+
+		free := [4]uint64{db.free.headPage, db.free.headSeq, db.free.tailPage, db.free.tailSeq}
+		db = reopen(t, db)
+		assert.Equal(t, free, [4]uint64{db.free.headPage, db.free.headSeq, db.free.tailPage, db.free.tailSeq})
+		assert.Empty(t, db.Verify())
+
+		// the pages freed before the reopen are used again, so the file stops growing
+		info, err := os.Stat(db.Path)
+		assert.NoError(t, err)
+		if round > 1 {
+			assert.Equal(t, size, info.Size(), "round %d", round)
+		}
+		size = info.Size()
+	}
+	count, err := db.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(200), count)
+	db.Close()
+}
+
+func TestFreeListBadMeta(t *testing.T) {
+	cases := map[string]func(meta []byte){
+		"head page 0": func(meta []byte) {
+			binary.LittleEndian.PutUint64(meta[32:], 0)
+		},
+		"head page past the file": func(meta []byte) {
+			binary.LittleEndian.PutUint64(meta[32:], binary.LittleEndian.Uint64(meta[24:]))
+		},
+		"tail page 0": func(meta []byte) {
+			binary.LittleEndian.PutUint64(meta[48:], 0)
+		},
+		"tail page past the file": func(meta []byte) {
+			binary.LittleEndian.PutUint64(meta[48:], binary.LittleEndian.Uint64(meta[24:])+5)
+		},
+		"head after the tail": func(meta []byte) {
+			binary.LittleEndian.PutUint64(meta[40:], binary.LittleEndian.Uint64(meta[56:])+1)
+		},
+	}
+	for name, change := range cases {
+		db := newKV(t, 1000)
+		_, err := db.DeleteRange(nil, nil)
+		assert.NoError(t, err)
+		db.Close()
+
+		rewriteSlot(t, db.Path, int(db.version%2), change)
+		err = (&KV{Path: db.Path}).Open()
+		var corrupt *btree.ErrCorrupt
+		assert.True(t, errors.As(err, &corrupt), "%s: %v", name, err)
+	}
+}
@@ -36,23 +36,47 @@ func createFilesync(file string) (int, error) {
 	return fd, nil
 }
 
+// Pages written by one pwritev, the IOV_MAX of Linux
+const WRITE_BATCH = 1024
+
+// Every page gets its checksum as it is written
 func writePages(db *KV) error {
-	size := (int(db.page.flushed) + len(db.page.temp)) * btree.BTREE_PAGE_SIZE
+	page := db.tree.PageSize()
+	size := (int(db.page.flushed) + len(db.page.temp)) * page
 	if err := extendMmap(db, size); err != nil {
 		return err
 	}
 
-	offset := int64(db.page.flushed * btree.BTREE_PAGE_SIZE)
-	if _, err := unix.Pwritev(db.fd, db.page.temp, offset); err != nil {
-		return err
+	for _, node := range db.page.temp {
+		btree.SetPageChecksum(node)
+	}
+	offset := int64(db.page.flushed) * int64(page)
+	for i := 0; i < len(db.page.temp); i += WRITE_BATCH {
+		batch := db.page.temp[i:min(i+WRITE_BATCH, len(db.page.temp))]
+		if _, err := unix.Pwritev(db.fd, batch, offset+int64(i*page)); err != nil {
+			return err
+		}
+	}
+
+	// pages reused from the free list and free list pages are rewritten in place
+	for ptr, node := range db.page.updates {
+		btree.SetPageChecksum(node)
+		if _, err := syscall.Pwrite(db.fd, node, int64(ptr)*int64(page)); err != nil {
+			return err
+		}
+		db.page.checkMu.Lock()
+		delete(db.page.checked, ptr)
+		db.page.checkMu.Unlock()
 	}
 
 	db.page.flushed += uint64(len(db.page.temp))
 	db.page.temp = db.page.temp[:0]
+	db.page.updates = map[uint64][]byte{}
 	return nil
 }
 
-func updateFile(db *KV) error {
+// Writes the pending pages and a meta page with root and version
+func updateFile(db *KV, root uint64, version uint64) error {
 	// 1. Write new nodes
 	if err := writePages(db); err != nil {
 		return fmt.Errorf("writing pages %w: ", err)
@@ -63,27 +87,48 @@ func updateFile(db *KV) error {
 	}
 
 	// 3. loadMeta / updateRoot
-	if err := updateMeta(db); err != nil {
+	if err := updateMeta(db, db.getMeta(root, version)); err != nil {
 		return fmt.Errorf("loading meta %w: ", err)
 	}
 	// 4. fsync
 	if err := syscall.Fsync(db.fd); err != nil {
 		return err
 	}
-
-	db.free.SetMaxSeq()
 	return nil
 }
 
-// func updateOrRevert(db *KV, meta []byte) error {
+// Writes the pending update with root, on error the size goes back to what it was
+// the root only changes once it is written, see Tx.Commit
+func updateOrRevert(db *KV, root uint64) error {
+	flushed := db.page.flushed
+	err := rewriteMeta(db)
+	if err == nil {
+		err = updateFile(db, root, db.version+1)
+	}
+	if err != nil {
+		db.failed = true
+		db.page.flushed = flushed
+		// discard temporaries
+		db.page.temp = db.page.temp[:0]
+		return err
+	}
+	return nil
+}
 
-// 	// 2 phase update
-// 	// revert to previous root
-// 	if err := updateFile(db); err != nil {
-// 		db.setMeta(meta)
-// 		// discard temporaries
-// 		db.page.temp = db.page.temp[:0]
-// 		return err
-// 	}
-// 	return nil
-// }
+// The meta page may have been written by a failed update, so it is fixed before the next one
+// the slot of the failed update is cleared, which leaves the one of the last commit
+func rewriteMeta(db *KV) error {
+	if !db.failed {
+		return nil
+	}
+	var empty [META_SIZE]byte
+	slot := int64((db.version + 1) % 2)
+	if _, err := syscall.Pwrite(db.fd, empty[:], slot*META_SLOT_SIZE); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	if err := syscall.Fsync(db.fd); err != nil {
+		return err
+	}
+	db.failed = false
+	return nil
+}
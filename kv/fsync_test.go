@@ -0,0 +1,111 @@
+package kv
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// What a failed update has to leave as it was
+type storeState struct {
+	root    uint64
+	flushed uint64
+	free    [5]uint64
+	updates map[uint64]string
+	version uint64
+}
+
+func stateOf(db *KV) storeState {
+	free, updates := pending(db)
+	free[4] = 0 // the next transaction sets it as it begins
+	return storeState{db.tree.GetRoot(), db.page.flushed, free, updates, db.version}
+}
+
+// Runs an update with fd in place of the file, it has to fail and leave the store as it was
+func failUpdate(t *testing.T, db *KV, fd int) {
+	before := stateOf(db)
+	file := db.fd
+	db.fd = fd
+	assert.Error(t, db.Set([]byte("k0001"), []byte("lost")))
+	db.fd = file
+
+	assert.True(t, db.failed)
+	assert.Equal(t, before, stateOf(db))
+	assert.Empty(t, db.page.temp)
+	assert.Empty(t, db.page.reuse)
+	val, err := db.Get([]byte("k0001"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v0001", string(val))
+}
+
+func TestUpdateFails(t *testing.T) {
+	db := newKV(t, 100)
+	// writes fail on a read only file
+	readOnly, err := syscall.Open(db.Path, os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	defer syscall.Close(readOnly)
+	failUpdate(t, db, readOnly)
+
+	// writes to /dev/null work, but it can not be synced
+	null, err := syscall.Open(os.DevNull, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	defer syscall.Close(null)
+	failUpdate(t, db, null)
+
+	// the next update goes through, and so does the one after a reopen
+	assert.NoError(t, db.Set([]byte("k0100"), []byte("v0100")))
+	assert.False(t, db.failed)
+	db = reopen(t, db)
+	defer db.Close()
+	assert.NoError(t, db.Set([]byte("k0101"), []byte("v0101")))
+	count, err := db.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(102), count)
+	assert.Empty(t, db.Verify())
+}
+
+// A failed update may have written its meta page before it failed
+// the next update clears it before writing anything, so that a crash leaves the last commit
+func TestUpdateFailsAfterMeta(t *testing.T) {
+	db := newKV(t, 100)
+	null, err := syscall.Open(os.DevNull, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	defer syscall.Close(null)
+	failUpdate(t, db, null)
+
+	// the meta of the failed update with a root that was never written
+	version := db.version
+	torn := db.getMeta(db.page.flushed+10, version+1)
+	_, err = syscall.Pwrite(db.fd, torn, int64((version+1)%2)*META_SLOT_SIZE)
+	assert.NoError(t, err)
+
+	// the update clearing it fails too, the meta stays as it was
+	readOnly, err := syscall.Open(db.Path, os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	defer syscall.Close(readOnly)
+	failUpdate(t, db, readOnly)
+
+	assert.NoError(t, db.Set([]byte("k0100"), []byte("v0100")))
+	assert.False(t, db.failed)
+	assert.Equal(t, version+1, db.version)
+	db = reopen(t, db)
+	defer db.Close()
+	assert.Equal(t, version+1, db.version)
+	val, err := db.Get([]byte("k0100"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v0100", string(val))
+	assert.Empty(t, db.Verify())
+
+	// a crash right after the meta is cleared leaves the last commit
+	failUpdate(t, db, null)
+	torn = db.getMeta(db.page.flushed+10, db.version+1)
+	_, err = syscall.Pwrite(db.fd, torn, int64((db.version+1)%2)*META_SLOT_SIZE)
+	assert.NoError(t, err)
+	assert.NoError(t, rewriteMeta(db))
+	db = reopen(t, db)
+	defer db.Close()
+	assert.Equal(t, version+1, db.version)
+	assert.Empty(t, db.Verify())
+}
@@ -0,0 +1,202 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/Manik-Jasrai/ByteStore.git/btree"
+	"github.com/stretchr/testify/assert"
+)
+
+type reverse struct{}
+
+func (reverse) Name() string                   { return "reverse" }
+func (reverse) Compare(a []byte, b []byte) int { return bytes.Compare(b, a) }
+
+// A store with keys a:000 to a:099 and b:000 to b:099, and keys of 0xff bytes
+func newScanKV(t *testing.T, cmp btree.Comparator) *KV {
+	db := &KV{Path: filepath.Join(t.TempDir(), "db"), Comparator: cmp}
+	assert.NoError(t, db.Open())
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, tx.Set([]byte(fmt.Sprintf("a:%03d", i)), []byte("a")))
+		assert.NoError(t, tx.Set([]byte(fmt.Sprintf("b:%03d", i)), []byte("b")))
+	}
+	for _, k := range []string{"\xff", "\xff\xff", "\xff\xff\x00", "\xff\xff\xff", "\xfe\xff"} {
+		assert.NoError(t, tx.Set([]byte(k), []byte("f")))
+	}
+	assert.NoError(t, tx.Commit())
+	return db
+}
+
+func prefixKeys(t *testing.T, db *KV, prefix string) []string {
+	var err error
+	keys := []string{}
+	for k := range db.ScanPrefixErr([]byte(prefix), &err) {
+		keys = append(keys, string(k))
+	}
+	assert.NoError(t, err)
+	return keys
+}
+
+func TestScanPrefix(t *testing.T) {
+	for _, cmp := range []btree.Comparator{nil, reverse{}} {
+		db := newScanKV(t, cmp)
+		keys := prefixKeys(t, db, "a:")
+		assert.Len(t, keys, 100)
+		first, last := "a:000", "a:099"
+		if cmp != nil {
+			first, last = last, first
+		}
+		assert.Equal(t, first, keys[0])
+		assert.Equal(t, last, keys[99])
+
+		assert.Empty(t, prefixKeys(t, db, "c:"))
+		assert.Empty(t, prefixKeys(t, db, "a:1000"))
+		assert.Equal(t, []string{"b:042"}, prefixKeys(t, db, "b:042"))
+		assert.Len(t, prefixKeys(t, db, ""), 205)
+
+		// 0xff bytes have no bytewise successor of the same length, the scan has to run to the end
+		ff := []string{"\xff", "\xff\xff", "\xff\xff\x00", "\xff\xff\xff"}
+		if cmp != nil {
+			ff = []string{"\xff\xff\xff", "\xff\xff\x00", "\xff\xff", "\xff"}
+		}
+		assert.Equal(t, ff, prefixKeys(t, db, "\xff"))
+		two := []string{"\xff\xff", "\xff\xff\x00", "\xff\xff\xff"}
+		if cmp != nil {
+			two = []string{"\xff\xff\xff", "\xff\xff\x00", "\xff\xff"}
+		}
+		assert.Equal(t, two, prefixKeys(t, db, "\xff\xff"))
+		assert.Empty(t, prefixKeys(t, db, "\xff\xff\xff\xff"))
+		db.Close()
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+	for _, cmp := range []btree.Comparator{nil, reverse{}} {
+		db := &KV{Path: filepath.Join(t.TempDir(), "db"), Comparator: cmp}
+		assert.NoError(t, db.Open())
+		// an empty file has no tree, once the keys are deleted it has the sentinel only
+		for round := 0; round < 2; round++ {
+			_, _, err := db.First()
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, _, err = db.Last()
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, _, err = db.Floor([]byte("k"))
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, _, err = db.Ceiling([]byte("k"))
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+			assert.NoError(t, db.Del([]byte("k")))
+		}
+		db.Close()
+
+		db = newScanKV(t, cmp)
+		first, last := "a:000", "\xff\xff\xff"
+		if cmp != nil {
+			first, last = last, first
+		}
+		key, val, err := db.First()
+		assert.NoError(t, err)
+		assert.Equal(t, first, string(key))
+		assert.NotEmpty(t, val)
+		key, _, err = db.Last()
+		assert.NoError(t, err)
+		assert.Equal(t, last, string(key))
+		db.Close()
+	}
+}
+
+func TestFloorCeiling(t *testing.T) {
+	for _, cmp := range []btree.Comparator{nil, reverse{}} {
+		db := newScanKV(t, cmp)
+		seek := func(f func([]byte) ([]byte, []byte, error), key string) string {
+			k, _, err := f([]byte(key))
+			if err != nil {
+				assert.ErrorIs(t, err, ErrNotFound)
+				return ""
+			}
+			return string(k)
+		}
+		// an exact key is its own floor and ceiling
+		for _, k := range []string{"a:000", "a:050", "b:099", "\xff\xff\xff"} {
+			assert.Equal(t, k, seek(db.Floor, k))
+			assert.Equal(t, k, seek(db.Ceiling, k))
+		}
+		// a missing key falls between 2 keys, in the order of the comparator
+		below, above := "a:050", "a:051"
+		if cmp != nil {
+			below, above = above, below
+		}
+		assert.Equal(t, below, seek(db.Floor, "a:0505"))
+		assert.Equal(t, above, seek(db.Ceiling, "a:0505"))
+		below, above = "b:099", "\xfe\xff"
+		if cmp != nil {
+			below, above = above, below
+		}
+		assert.Equal(t, below, seek(db.Floor, "c"))
+		assert.Equal(t, above, seek(db.Ceiling, "c"))
+
+		// past both ends
+		lo, hi := "0", "\xff\xff\xff\xff"
+		if cmp != nil {
+			lo, hi = hi, lo
+		}
+		assert.Equal(t, "", seek(db.Floor, lo))
+		assert.NotEqual(t, "", seek(db.Ceiling, lo))
+		assert.Equal(t, "", seek(db.Ceiling, hi))
+		assert.NotEqual(t, "", seek(db.Floor, hi))
+		db.Close()
+	}
+}
+
+func TestScanErr(t *testing.T) {
+	db := newKV(t, 1000)
+	var err error
+	n := 0
+	for range db.ScanErr(nil, nil, &err) {
+		n++
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, n)
+
+	// a done transaction
+	tx, err := db.BeginRead()
+	assert.NoError(t, err)
+	tx.Done()
+	for range tx.ScanErr(nil, nil, &err) {
+		t.Fatal("scan of a done transaction")
+	}
+	assert.ErrorIs(t, err, ErrTxDone)
+
+	// a corrupt page
+	root := db.tree.GetRoot()
+	db.Close()
+	flipByte(t, db.Path, int64(root)*btree.BTREE_PAGE_SIZE+100)
+	db = &KV{Path: db.Path}
+	assert.NoError(t, db.Open())
+	for range db.ScanErr(nil, nil, &err) {
+		t.Fatal("scan of a corrupt tree")
+	}
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+	err = nil
+	for range db.ScanPrefixErr([]byte("k"), &err) {
+		t.Fatal("scan of a corrupt tree")
+	}
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+
+	// a closed store
+	db.Close()
+	for range db.ScanErr(nil, nil, &err) {
+		t.Fatal("scan of a closed store")
+	}
+	assert.ErrorIs(t, err, ErrClosed)
+	for range db.ScanPrefixErr(nil, &err) {
+		t.Fatal("scan of a closed store")
+	}
+	assert.ErrorIs(t, err, ErrClosed)
+}
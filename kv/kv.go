@@ -1,18 +1,45 @@
 package kv
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
+	"sync"
 	"syscall"
 
 	"github.com/Manik-Jasrai/ByteStore.git/btree"
 )
 
+// When page checksums are verified on read
+const (
+	CHECKSUM_LAZY   = 0 // the first time a page is read after Open
+	CHECKSUM_ALWAYS = 1 // every time a page is read
+)
+
 type KV struct {
 	Path string
+	// Allow keys larger than btree.BTREE_MAX_KEY_SIZE
+	LongKeys bool
+	// Write prefix compressed nodes
+	Compress bool
+	// Order of the keys, nil is btree.BytewiseComparator
+	// a database can not be reopened with a different one
+	Comparator btree.Comparator
+	// Page size of a new database, 0 is btree.BTREE_PAGE_SIZE
+	// an existing database keeps the one it was created with
+	PageSize int
+	// Fraction of a page below which nodes are rebalanced on delete, 0 is btree.BTREE_MIN_FILL
+	MinFill float64
+	// How full nodes are split, nil is btree.AppendSplit(btree.BTREE_APPEND_FILL)
+	SplitPolicy btree.SplitPolicy
+	// CHECKSUM_LAZY or CHECKSUM_ALWAYS
+	Checksum int
 
 	fd   int
-	tree btree.BTree
+	tree btree.BTree // as of the last commit, see ReadTx
 
 	mmap struct {
 		total  int      // # of pages
@@ -24,11 +51,23 @@ type KV struct {
 		nappend uint64            // number of pages to be appended
 		updates map[uint64][]byte // pending updates
 		temp    [][]byte
+		checked map[uint64]bool // pages whose checksum was verified, see CHECKSUM_LAZY
+		checkMu sync.Mutex      // readers check pages too
+		reuse   []uint64        // pages the pending update wrote and freed again
 	}
 
-	free FreeList
+	free   FreeList
+	tx     *Tx        // the transaction in progress
+	writer sync.Mutex // held by tx
 
-	// failed bool
+	// what read transactions see, it changes with each commit
+	mu          sync.Mutex // guards the root of tree, mmap.chunks and the fields below
+	version     uint64     // of the last commit, see META_VERSION_OFFSET
+	readers     map[uint64]int
+	readersDone sync.Cond // signalled when a read transaction is done, see Close
+
+	open   bool // between a successful Open and Close
+	failed bool // an update failed, the meta page on disk is unknown
 }
 
 func (db *KV) Open() error {
@@ -41,6 +80,32 @@ func (db *KV) Open() error {
 	db.fd = fd
 
 	db.page.updates = map[uint64][]byte{}
+	db.page.checked = map[uint64]bool{}
+	db.readers = map[uint64]int{}
+	db.readersDone.L = &db.mu
+
+	if db.Checksum != CHECKSUM_LAZY && db.Checksum != CHECKSUM_ALWAYS {
+		db.Close()
+		return fmt.Errorf("KV Open bad checksum mode %d", db.Checksum)
+	}
+
+	if db.MinFill != 0 {
+		if err := btree.CheckMinFill(db.MinFill); err != nil {
+			db.Close()
+			return fmt.Errorf("KV Open %w : ", err)
+		}
+		db.tree.SetMinFill(db.MinFill)
+	}
+
+	// the page size is needed before the file can be mapped
+	meta, err := readMetaPage(db)
+	if err == nil {
+		err = readPageSize(db, meta)
+	}
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("KV Open %w : ", err)
+	}
 
 	// initialize mmap TODO
 	fileSize, chunk, err := mmapInit(db)
@@ -51,18 +116,31 @@ func (db *KV) Open() error {
 	db.mmap.chunks = [][]byte{chunk}
 
 	// Map the tree functions to implemented
-	db.tree.SetGet(db.pageRead)
-	db.tree.SetNew(db.pageAlloc)
-	db.tree.SetDel(db.pageDel)
+	db.tree.SetStore(fileStore{db})
+	db.tree.SetLongKeys(db.LongKeys)
+	db.tree.SetCompress(db.Compress)
+	db.tree.SetComparator(db.Comparator)
+	db.tree.SetSplitPolicy(db.SplitPolicy)
 	// Free list callbacks
 	db.free.get = db.pageRead
 	db.free.new = db.pageAppend
 	db.free.set = db.pageWrite
+	db.free.pageSize = db.tree.PageSize()
 
-	err = readMeta(db, int64(fileSize))
+	err = readMeta(db, meta, int64(fileSize))
 	if err != nil {
 		goto fail
 	}
+	// the first commit has a slot to fall back to if its meta page is torn
+	if meta == nil {
+		if err = updateFile(db, 0, 0); err != nil {
+			goto fail
+		}
+	}
+	db.free.AddCommit(db.version)
+	db.mu.Lock()
+	db.open = true
+	db.mu.Unlock()
 	return nil
 
 fail:
@@ -70,53 +148,290 @@ fail:
 	return fmt.Errorf("KV Open %w : ", err)
 }
 
-func (db *KV) Close() {
+// Unmaps and closes the file
+// new transactions fail with ErrClosed, and the ones in progress are waited for since they read the mapping,
+// so it can not be called while holding one
+// closing it again returns ErrClosed
+func (db *KV) Close() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.fd < 0 {
+		return ErrClosed
+	}
+	db.open = false
+	for len(db.readers) > 0 {
+		db.readersDone.Wait()
+	}
 	for _, chunk := range db.mmap.chunks {
 		if err := syscall.Munmap(chunk); err != nil {
-			return
+			return fmt.Errorf("KV Close: %w", err)
 		}
 	}
-	syscall.Close(db.fd)
+	db.mmap.chunks = nil
+	fd := db.fd
+	db.fd = -1
+	if err := syscall.Close(fd); err != nil {
+		return fmt.Errorf("KV Close: %w", err)
+	}
+	return nil
+}
+
+// The mapped file can only be read between Open and Close
+func (db *KV) checkOpen() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.open {
+		return ErrClosed
+	}
+	return nil
 }
 
-// TODO
+// Returns ErrNotFound if the key does not exist
+// the reads of the store are read transactions of their own, see BeginRead
 func (db *KV) Get(key []byte) ([]byte, error) {
-	if len(key) == 0 {
-		return nil, fmt.Errorf("empty key")
+	tx, err := db.BeginRead()
+	if err != nil {
+		return nil, err
 	}
+	defer tx.Done()
+	// the value is in the mapping, its page can be reused once the transaction is done
+	val, err := tx.Get(key)
+	return bytes.Clone(val), err
+}
+
+// Iterates over the keys in [start, end) in order
+// an empty start or end means there is no bound on that side
+// it stops early when the store is closed or a page is corrupt, use ScanErr to tell
+func (db *KV) Scan(start []byte, end []byte) iter.Seq2[[]byte, []byte] {
+	return db.ScanErr(start, end, nil)
+}
 
-	val := db.tree.Get(key)
-	if val == nil {
-		return nil, fmt.Errorf("key not found")
+// Scan that sets *err to why it stopped early, and to nil when it got to the end
+// err may be nil
+func (db *KV) ScanErr(start []byte, end []byte, err *error) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		tx, e := db.BeginRead()
+		if e != nil {
+			setErr(err, e)
+			return
+		}
+		defer tx.Done()
+		tx.ScanErr(start, end, err)(yield)
 	}
+}
 
-	return val, nil
+// Iterates over all keys starting with prefix in order
+// keys sharing a prefix are only next to each other in the bytewise order
+// other comparators have to look at every key
+// it stops early like Scan, use ScanPrefixErr to tell
+func (db *KV) ScanPrefix(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return db.ScanPrefixErr(prefix, nil)
 }
-func (db *KV) Del(key []byte) error {
-	if len(key) == 0 {
-		return fmt.Errorf("empty key")
+
+// ScanPrefix that sets *err to why it stopped early, see ScanErr
+func (db *KV) ScanPrefixErr(prefix []byte, err *error) iter.Seq2[[]byte, []byte] {
+	bytewise := db.tree.Comparator() == btree.BytewiseComparator
+	return func(yield func([]byte, []byte) bool) {
+		tx, e := db.BeginRead()
+		if e != nil {
+			setErr(err, e)
+			return
+		}
+		defer tx.Done()
+		it := tx.tree.SeekFirst()
+		if bytewise {
+			it = tx.tree.SeekGE(prefix)
+		}
+		defer func() { setErr(err, it.Err()) }()
+		for ; it.Valid(); it.Next() {
+			key, val := it.Deref()
+			if it.Err() != nil {
+				return
+			}
+			if !bytes.HasPrefix(key, prefix) {
+				if bytewise {
+					return
+				}
+				continue
+			}
+			if !yield(key, val) {
+				return
+			}
+		}
+	}
+}
+
+// Sets *err if err is not nil, see ScanErr
+func setErr(err *error, e error) {
+	if err != nil {
+		*err = e
 	}
+}
+
+// Smallest key in the store
+func (db *KV) First() ([]byte, []byte, error) {
+	return db.deref((*btree.BTree).SeekFirst)
+}
 
-	// meta := db.getMeta()
+// Largest key in the store
+func (db *KV) Last() ([]byte, []byte, error) {
+	return db.deref((*btree.BTree).SeekLast)
+}
+
+// Largest key <= key
+func (db *KV) Floor(key []byte) ([]byte, []byte, error) {
+	return db.deref(func(tree *btree.BTree) *btree.BIter { return tree.SeekLE(key) })
+}
 
-	// Check if key exists
-	if db.tree.Get(key) == nil {
-		return fmt.Errorf("key not found")
+// Smallest key >= key
+func (db *KV) Ceiling(key []byte) ([]byte, []byte, error) {
+	return db.deref(func(tree *btree.BTree) *btree.BIter { return tree.SeekGE(key) })
+}
+
+// KV pair at the iterator seek returns
+// it is not valid on an empty tree or on the sentinel key, which is ErrNotFound
+func (db *KV) deref(seek func(tree *btree.BTree) *btree.BIter) ([]byte, []byte, error) {
+	tx, err := db.BeginRead()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Done()
+	it := seek(&tx.tree)
+	if !it.Valid() {
+		if err := it.Err(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrNotFound
+	}
+	key, val := it.Deref()
+	return bytes.Clone(key), bytes.Clone(val), it.Err()
+}
+
+// Number of keys in [start, end)
+// an empty start or end means there is no bound on that side
+func (db *KV) Count(start []byte, end []byte) (uint64, error) {
+	tx, err := db.BeginRead()
+	if err != nil {
+		return 0, err
 	}
+	defer tx.Done()
+	return tx.Count(start, end)
+}
+
+// Number of keys < key
+func (db *KV) Rank(key []byte) (uint64, error) {
+	tx, err := db.BeginRead()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Done()
+	return tx.tree.Rank(key)
+}
+
+// Key of rank i, counting from 0
+func (db *KV) Select(i uint64) ([]byte, []byte, error) {
+	return db.deref(func(tree *btree.BTree) *btree.BIter { return tree.Select(i) })
+}
 
-	// Delete from tree
-	db.tree.Delete(key)
+// Returns ErrNotFound if the key does not exist
+// the writes of the store are transactions of their own, see Begin
+func (db *KV) Del(key []byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.Del(key); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
 
-	return updateFile(db)
+// Deletes the keys in [start, end) and returns how many there were
+// an empty start or end means there is no bound on that side
+func (db *KV) DeleteRange(start []byte, end []byte) (uint64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	count, err := tx.DeleteRange(start, end)
+	if err != nil {
+		tx.Abort()
+		return 0, err
+	}
+	return count, tx.Commit()
 }
 
 func (db *KV) Set(key []byte, val []byte) error {
-	if len(key) == 0 {
-		return fmt.Errorf("empty key")
+	_, err := db.Update(&btree.UpdateReq{Key: key, Val: val})
+	return err
+}
+
+// Inserts or updates a key as req.Mode allows
+// the outcome and the old value are reported in req
+func (db *KV) Update(req *btree.UpdateReq) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	updated, err := tx.Update(req)
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return updated, tx.Commit()
+}
+
+// Loads KV pairs sorted in key order into an empty store
+// nodes are filled up to fill (0, 1] of a page and the file is synced once at the end
+func (db *KV) BulkLoad(kvs iter.Seq2[[]byte, []byte], fill float64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.tree.BulkLoad(kvs, fill); err != nil {
+		tx.Abort()
+		return err
+	}
+	tx.dirty = true
+	return tx.Commit()
+}
+
+// Structural problems of the tree, see btree.BTree.Verify
+func (db *KV) Verify() []btree.Violation {
+	tx, err := db.BeginRead()
+	if err != nil {
+		return nil
+	}
+	defer tx.Done()
+	return tx.tree.Verify()
+}
+
+// Pages of the tree as DOT or JSON, see btree.BTree.Dump
+func (db *KV) Dump(w io.Writer, format int) error {
+	tx, err := db.BeginRead()
+	if err != nil {
+		return err
 	}
-	// meta := db.getMeta()
-	db.tree.Insert(key, val)
-	return updateFile(db)
+	defer tx.Done()
+	return tx.tree.Dump(w, format)
+}
+
+// The file as the page store of the tree
+type fileStore struct {
+	db *KV
+}
+
+func (store fileStore) Get(ptr uint64) []byte {
+	return store.db.pageRead(ptr)
+}
+func (store fileStore) New(page []byte) uint64 {
+	return store.db.pageAlloc(page)
+}
+func (store fileStore) Del(ptr uint64) {
+	store.db.pageDel(ptr)
 }
 
 // Btree.get, read a page
@@ -124,25 +439,64 @@ func (db *KV) pageRead(ptr uint64) []byte {
 	if node, ok := db.page.updates[ptr]; ok {
 		return node
 	}
+	if node := db.pageTemp(ptr); node != nil {
+		return node
+	}
 
 	return db.pageReadFile(ptr)
 }
 
+// Page appended by the pending update, nil if it is in the file
+func (db *KV) pageTemp(ptr uint64) []byte {
+	if ptr < db.page.flushed {
+		return nil
+	}
+	if idx := ptr - db.page.flushed; idx < uint64(len(db.page.temp)) {
+		return db.page.temp[idx]
+	}
+	panic(&btree.ErrCorrupt{Page: ptr, Reason: "pointer past the end of the file"})
+}
+
 func (db *KV) pageReadFile(ptr uint64) []byte {
+	return db.pageReadChunks(db.mmap.chunks, ptr)
+}
+
+// Page of the file mapped by chunks, readers keep the chunks they began with
+func (db *KV) pageReadChunks(chunks [][]byte, ptr uint64) []byte {
+	size := uint64(db.tree.PageSize())
 	start := uint64(0)
 	// 'start' tells us the starting page number of the chunk
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/btree.BTREE_PAGE_SIZE // No of pages(nodes) in a chunk
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk))/size // No of pages(nodes) in a chunk
 		// 'end' tells us the number of the page at the end of the chunk
 		if ptr < end {
 			// Our page is present in the chunk
-			offset := btree.BTREE_PAGE_SIZE * (ptr - start) // position of our page
-
-			return chunk[offset : offset+btree.BTREE_PAGE_SIZE]
+			offset := size * (ptr - start) // position of our page
+			page := chunk[offset : offset+size]
+			db.checkPage(ptr, page)
+			return page
 		}
 		start = end
 	}
-	panic("bad ptr")
+	// unwinds to the tree method that read it, see btree.ErrCorrupt
+	panic(&btree.ErrCorrupt{Page: ptr, Reason: "pointer past the end of the file"})
+}
+
+// Panics with btree.ErrCorrupt if the page is not what was written
+func (db *KV) checkPage(ptr uint64, page []byte) {
+	if db.Checksum == CHECKSUM_LAZY {
+		db.page.checkMu.Lock()
+		defer db.page.checkMu.Unlock()
+		if db.page.checked[ptr] {
+			return
+		}
+	}
+	if !btree.CheckPageChecksum(page) {
+		panic(&btree.ErrCorrupt{Page: ptr, Reason: "checksum mismatch"})
+	}
+	if db.Checksum == CHECKSUM_LAZY {
+		db.page.checked[ptr] = true
+	}
 }
 
 func (db *KV) pageAppend(node []byte) uint64 {
@@ -154,6 +508,17 @@ func (db *KV) pageAppend(node []byte) uint64 {
 
 // Btree.new , allocate a new page
 func (db *KV) pageAlloc(node []byte) uint64 {
+	// nothing in the file points to them yet
+	if n := len(db.page.reuse); n > 0 {
+		ptr := db.page.reuse[n-1]
+		db.page.reuse = db.page.reuse[:n-1]
+		if ptr >= db.page.flushed {
+			db.page.temp[ptr-db.page.flushed] = node
+		} else {
+			db.page.updates[ptr] = node
+		}
+		return ptr
+	}
 	// we check the free list first for an empty page
 	if ptr := db.free.PopHead(); ptr != 0 {
 		db.page.updates[ptr] = node
@@ -165,11 +530,14 @@ func (db *KV) pageAlloc(node []byte) uint64 {
 
 // Btree.del
 func (db *KV) pageDel(ptr uint64) {
-
-	delete(db.page.updates, ptr)
+	// a page of the pending update can be used again right away
+	// the tree never frees the free list nodes, which are pending too
+	if _, ok := db.page.updates[ptr]; ok || ptr >= db.page.flushed {
+		delete(db.page.updates, ptr)
+		db.page.reuse = append(db.page.reuse, ptr)
+		return
+	}
 	db.free.PushTail(ptr)
-
-	return
 }
 
 // FreeList.set, updates an existing page
@@ -177,19 +545,32 @@ func (db *KV) pageWrite(ptr uint64) []byte {
 	if node, ok := db.page.updates[ptr]; ok {
 		return node
 	}
-	node := make([]byte, btree.BTREE_PAGE_SIZE)
+	if node := db.pageTemp(ptr); node != nil {
+		return node // not written yet
+	}
+	node := make([]byte, db.tree.PageSize())
 	copy(node, db.pageReadFile(ptr))
 
 	db.page.updates[ptr] = node
 	return node
 }
 
-func (db *KV) getMeta() []byte {
-	var data [32]byte
+// Meta page of the commit version with root as the root of the tree
+func (db *KV) getMeta(root uint64, version uint64) []byte {
+	var data [META_SIZE]byte
 
 	copy(data[0:], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[16:], db.tree.GetRoot())
+	binary.LittleEndian.PutUint64(data[16:], root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:], db.free.headPage)
+	binary.LittleEndian.PutUint64(data[40:], db.free.headSeq)
+	binary.LittleEndian.PutUint64(data[48:], db.free.tailPage)
+	binary.LittleEndian.PutUint64(data[56:], db.free.tailSeq)
+	copy(data[META_CMP_OFFSET:], db.tree.Comparator().Name())
+	binary.LittleEndian.PutUint64(data[META_PAGE_SIZE_OFFSET:], uint64(db.tree.PageSize()))
+	binary.LittleEndian.PutUint64(data[META_VERSION_OFFSET:], version)
+	binary.LittleEndian.PutUint32(data[META_FORMAT_OFFSET:], DB_FORMAT)
+	binary.LittleEndian.PutUint32(data[META_CRC_OFFSET:], crc32.Checksum(data[:META_CRC_OFFSET], metaTable))
 	return data[:]
 }
 func (db *KV) setMeta(data []byte) {
@@ -197,4 +578,9 @@ func (db *KV) setMeta(data []byte) {
 	used := binary.LittleEndian.Uint64(data[24:])
 	db.tree.SetRoot(root)
 	db.page.flushed = used
+	db.free.headPage = binary.LittleEndian.Uint64(data[32:])
+	db.free.headSeq = binary.LittleEndian.Uint64(data[40:])
+	db.free.tailPage = binary.LittleEndian.Uint64(data[48:])
+	db.free.tailSeq = binary.LittleEndian.Uint64(data[56:])
+	db.version = metaVersion(data)
 }
@@ -0,0 +1,185 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Manik-Jasrai/ByteStore.git/btree"
+	"github.com/stretchr/testify/assert"
+)
+
+// A store in a new file with n keys k0000.. set to v0000..
+func newKV(t *testing.T, n int) *KV {
+	db := &KV{Path: filepath.Join(t.TempDir(), "db")}
+	assert.NoError(t, db.Open())
+	for i := 0; i < n; i++ {
+		assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%04d", i))))
+	}
+	return db
+}
+
+// Opens the file of db again with the same options
+func reopen(t *testing.T, db *KV) *KV {
+	db.Close()
+	db = &KV{Path: db.Path, Checksum: db.Checksum}
+	assert.NoError(t, db.Open())
+	return db
+}
+
+// Flips the bits of the byte at off, the mapping of an open store sees it too
+func flipByte(t *testing.T, path string, off int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	defer f.Close()
+	b := []byte{0}
+	_, err = f.ReadAt(b, off)
+	assert.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, off)
+	assert.NoError(t, err)
+}
+
+func TestChecksum(t *testing.T) {
+	db := newKV(t, 1000)
+	root := db.tree.GetRoot()
+	db.Close()
+
+	flipByte(t, db.Path, int64(root)*btree.BTREE_PAGE_SIZE+100)
+	db = &KV{Path: db.Path}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	_, err := db.Get([]byte("k0001"))
+	assert.ErrorIs(t, err, &ErrCorrupt{})
+	assert.Contains(t, err.Error(), "checksum mismatch")
+	assert.Equal(t, 1, len(db.Verify()))
+}
+
+func TestChecksumModes(t *testing.T) {
+	for _, mode := range []int{CHECKSUM_LAZY, CHECKSUM_ALWAYS} {
+		db := newKV(t, 1000)
+		db.Checksum = mode
+		db = reopen(t, db)
+		_, err := db.Get([]byte("k0001"))
+		assert.NoError(t, err)
+
+		// the end of the root is not used, only the checksum sees the change
+		root := db.tree.GetRoot()
+		flipByte(t, db.Path, int64(root+1)*btree.BTREE_PAGE_SIZE-1)
+		_, err = db.Get([]byte("k0001"))
+		if mode == CHECKSUM_LAZY {
+			assert.NoError(t, err) // checked on the first read only
+		} else {
+			assert.ErrorIs(t, err, &ErrCorrupt{})
+		}
+		db.Close()
+	}
+	assert.Error(t, (&KV{Path: filepath.Join(t.TempDir(), "db"), Checksum: 2}).Open())
+}
+
+// Close waits for a read transaction, which keeps its snapshot meanwhile
+func TestCloseWaitsForReaders(t *testing.T) {
+	db := newKV(t, 10)
+	tx, err := db.BeginRead()
+	assert.NoError(t, err)
+	closed := make(chan error)
+	go func() { closed <- db.Close() }()
+
+	select {
+	case <-closed:
+		t.Fatal("closed during the transaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = db.BeginRead()
+	assert.ErrorIs(t, err, ErrClosed)
+	val, err := tx.Get([]byte("k0001"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v0001", string(val))
+	it := tx.SeekGE([]byte("k0005"))
+	assert.True(t, it.Valid())
+
+	tx.Done()
+	assert.NoError(t, <-closed)
+	_, err = db.Begin()
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = db.Get([]byte("k0001"))
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestCloseTwice(t *testing.T) {
+	db := newKV(t, 10)
+	assert.NoError(t, db.Close())
+	assert.ErrorIs(t, db.Close(), ErrClosed)
+	db = reopen(t, db)
+	assert.NoError(t, db.Close())
+
+	// a failed Open closes the file already
+	db = &KV{Path: db.Path, Checksum: 7}
+	assert.Error(t, db.Open())
+	assert.ErrorIs(t, db.Close(), ErrClosed)
+}
+
+// Close waits for the write transaction of another goroutine, which then commits
+func TestCloseWaitsForWriter(t *testing.T) {
+	db := newKV(t, 10)
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	closed := make(chan error)
+	go func() { closed <- db.Close() }()
+
+	assert.NoError(t, tx.Set([]byte("k0100"), []byte("v0100")))
+	select {
+	case <-closed:
+		t.Fatal("closed during the transaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, <-closed)
+
+	db = &KV{Path: db.Path}
+	assert.NoError(t, db.Open())
+	defer db.Close()
+	val, err := db.Get([]byte("k0100"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v0100", string(val))
+}
+
+// Readers and a writer run until the store is closed under them, run with -race
+func TestCloseConcurrent(t *testing.T) {
+	db := newKV(t, 100)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				val, err := db.Get([]byte(fmt.Sprintf("k%04d", i%100)))
+				if errors.Is(err, ErrClosed) {
+					return
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("v%04d", i%100), string(val[:5]))
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			key := fmt.Sprintf("k%04d", i%100)
+			err := db.Set([]byte(key), []byte(fmt.Sprintf("v%04d %d", i%100, i)))
+			if errors.Is(err, ErrClosed) {
+				return
+			}
+			assert.NoError(t, err)
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, db.Close())
+	wg.Wait()
+}
@@ -3,33 +3,37 @@ package kv
 import (
 	"encoding/binary"
 
-	"github.com/Manik-Jasrai/ByteStore.git/btree"
 	"github.com/Manik-Jasrai/ByteStore.git/utils"
 )
 
-const FREE_LIST_HEADER = 8
-const FREE_LIST_CAP = (btree.BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+const FREE_LIST_HEADER = 16
+
+// Number of pointers in a free list node
+func freeListCap(pageSize int) int {
+	return (pageSize - FREE_LIST_HEADER) / 8
+}
 
 /*
 node format
-|  8B  |   n*8B   |  ...   |
-| next | pointers | unused |
+|    4B    |    4B    |  8B  |   n*8B   |  ...   |
+| reserved | checksum | next | pointers | unused |
 */
+// the checksum is where tree pages keep it, see btree.PAGE_CHECKSUM_OFFSET
 type LNode []byte
 
 // TODO:
 // getters & setters
 func (node LNode) getNext() uint64 {
-	return binary.LittleEndian.Uint64(node[0:])
+	return binary.LittleEndian.Uint64(node[8:])
 }
 func (node LNode) setNext(next uint64) {
-	binary.LittleEndian.PutUint64(node[0:], next)
+	binary.LittleEndian.PutUint64(node[8:], next)
 }
 func (node LNode) getPtr(idx int) uint64 {
-	utils.Assert(idx >= 0 && idx < FREE_LIST_CAP, "Index Out of Bounds : LNode GetPointer")
-	return binary.LittleEndian.Uint64(node[FREE_LIST_HEADER+idx:])
+	utils.Assert(idx >= 0 && idx < freeListCap(len(node)), "Index Out of Bounds : LNode GetPointer")
+	return binary.LittleEndian.Uint64(node[FREE_LIST_HEADER+8*idx:])
 }
 func (node LNode) setPtr(idx int, ptr uint64) {
-	utils.Assert(idx >= 0 && idx < FREE_LIST_CAP, "Index Out of Bounds : LNode SetPointer")
-	binary.LittleEndian.PutUint64(node[FREE_LIST_HEADER+idx:], ptr)
+	utils.Assert(idx >= 0 && idx < freeListCap(len(node)), "Index Out of Bounds : LNode SetPointer")
+	binary.LittleEndian.PutUint64(node[FREE_LIST_HEADER+8*idx:], ptr)
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"syscall"
 
 	"github.com/Manik-Jasrai/ByteStore.git/btree"
@@ -12,42 +13,152 @@ import (
 
 const DB_SIG = "0123456789ABCDEF"
 
+// Layout of the file, a file of another format is refused with ErrFormat
+// format 1 was written before pages had a checksum, its node header is 4 bytes shorter
+// and its meta page is a single slot without a version, a format or a crc
+const DB_FORMAT = 2
+
 // New Meta Page
 /*
-| sig | root_ptr | page_used | head_page | head_seq | tail_page | tail_seq |
-| 16B |    8B    |     8B    |     8B    |    8B    |     8B    |    8B    |
+| sig | root_ptr | page_used | head_page | head_seq | tail_page | tail_seq | comparator | page_size | version | format | crc |
+| 16B |    8B    |     8B    |     8B    |    8B    |     8B    |    8B    |     32B    |     8B    |    8B   |   4B   |  4B |
 */
+// the comparator name is zero padded
+const META_CMP_OFFSET = 64
+const META_CMP_SIZE = 32
+const META_PAGE_SIZE_OFFSET = 96
+const META_VERSION_OFFSET = 104
+const META_FORMAT_OFFSET = 112
+const META_CRC_OFFSET = 116
+const META_SIZE = 120
+
+// The meta page has 2 slots, each commit writes the one the previous commit did not
+// the slot with the newest version and a good crc is used, so a torn write loses only the commit being written
+const META_SLOT_SIZE = 512 // a disk sector
+
+var metaTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Newest good slot of the meta page, nil if the file is new
+// a slot with data and a bad crc is a torn write or corruption, the file is corrupt when there is no other
+// the meta page is read with a plain read since we can not map the file without it
+func readMetaPage(db *KV) ([]byte, error) {
+	var data [2 * META_SLOT_SIZE]byte
+	_, err := syscall.Pread(db.fd, data[:], 0)
+	if err != nil {
+		return nil, fmt.Errorf("read meta page: %w", err)
+	}
+	var meta []byte
+	written := false
+	for slot := 0; slot < 2; slot++ {
+		cand := data[slot*META_SLOT_SIZE : slot*META_SLOT_SIZE+META_SIZE]
+		// never written, or cleared after a failed update, see rewriteMeta
+		if bytes.Count(cand, []byte{0}) == META_SIZE {
+			continue
+		}
+		written = true
+		if !metaGood(cand) {
+			continue
+		}
+		if meta == nil || metaVersion(cand) > metaVersion(meta) {
+			meta = cand
+		}
+	}
+	// Open did not get to the meta page of the new file
+	if !written {
+		return nil, nil
+	}
+	if meta == nil {
+		old := data[:META_SIZE]
+		if bytes.Equal([]byte(DB_SIG), old[:16]) && bytes.Count(old[META_VERSION_OFFSET:], []byte{0}) == META_SIZE-META_VERSION_OFFSET {
+			return nil, fmt.Errorf("%w: file has format 1, this version reads format %d", ErrFormat, DB_FORMAT)
+		}
+		return nil, &btree.ErrCorrupt{Page: 0, Reason: "no good meta slot"}
+	}
+	if format := binary.LittleEndian.Uint32(meta[META_FORMAT_OFFSET:]); format != DB_FORMAT {
+		return nil, fmt.Errorf("%w: file has format %d, this version reads format %d", ErrFormat, format, DB_FORMAT)
+	}
+	return meta, nil
+}
+
+func metaGood(meta []byte) bool {
+	crc := binary.LittleEndian.Uint32(meta[META_CRC_OFFSET:])
+	return bytes.Equal([]byte(DB_SIG), meta[:16]) && crc == crc32.Checksum(meta[:META_CRC_OFFSET], metaTable)
+}
+
+func metaVersion(meta []byte) uint64 {
+	return binary.LittleEndian.Uint64(meta[META_VERSION_OFFSET:])
+}
+
+// Page size of the file, or of the new database if it is empty
+func readPageSize(db *KV, meta []byte) error {
+	size := db.PageSize
+	if size == 0 {
+		size = btree.BTREE_PAGE_SIZE
+	}
+	if err := btree.CheckPageSize(size); err != nil {
+		return err
+	}
+
+	if meta != nil {
+		stored := int(binary.LittleEndian.Uint64(meta[META_PAGE_SIZE_OFFSET:]))
+		if err := btree.CheckPageSize(stored); err != nil {
+			return err
+		}
+		if db.PageSize != 0 && db.PageSize != stored {
+			return fmt.Errorf("page size mismatch: file uses %d, opened with %d", stored, db.PageSize)
+		}
+		size = stored
+	}
+	db.tree.SetPageSize(size)
+	return nil
+}
 
 // Reading meta data from storage and putting it to KV data structure
-func readMeta(db *KV, fileSize int64) error {
-	if fileSize == 0 || db.mmap.total == 0 {
+func readMeta(db *KV, meta []byte, fileSize int64) error {
+	if len(db.tree.Comparator().Name()) > META_CMP_SIZE {
+		return errors.New("comparator name too long")
+	}
+	if meta == nil {
 		db.page.flushed = 2 // reserve 2 pages, 1 meta page and 1 fl node
 		db.free.headPage = 1
 		db.free.tailPage = 1
+		// the free list node is written by Open with the meta page of version 0
+		db.page.updates[1] = make([]byte, db.tree.PageSize())
+		db.version = 0
 
 		return nil
 	}
 
-	data := db.mmap.chunks[0]
-	root := binary.LittleEndian.Uint64(data[16:])
-	used := binary.LittleEndian.Uint64(data[24:])
-	// verify the page
-	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
-		return errors.New("bad signature")
-	}
+	root := binary.LittleEndian.Uint64(meta[16:])
+	used := binary.LittleEndian.Uint64(meta[24:])
+	headPage := binary.LittleEndian.Uint64(meta[32:])
+	headSeq := binary.LittleEndian.Uint64(meta[40:])
+	tailPage := binary.LittleEndian.Uint64(meta[48:])
+	tailSeq := binary.LittleEndian.Uint64(meta[56:])
 
-	bad := (used >= 1 && used <= uint64(db.mmap.total)/btree.BTREE_PAGE_SIZE)
-	bad = bad || !(root > 0 && root < used)
+	// the meta page and the first free list node come first, a 0 root is an empty tree
+	bad := !(used >= 2 && used <= uint64(fileSize)/uint64(db.tree.PageSize()))
+	bad = bad || root >= used
+	// the free list nodes are pages of the file, and the head never passes the tail
+	bad = bad || headPage == 0 || headPage >= used || tailPage == 0 || tailPage >= used
+	bad = bad || headSeq > tailSeq
 	if bad {
-		return errors.New("bad master page")
+		return &btree.ErrCorrupt{Page: 0, Reason: "bad master page"}
+	}
+	// a different order would make every lookup wrong
+	name := string(bytes.TrimRight(meta[META_CMP_OFFSET:META_CMP_OFFSET+META_CMP_SIZE], "\x00"))
+	if name != db.tree.Comparator().Name() {
+		return fmt.Errorf("comparator mismatch: file uses %q, opened with %q", name, db.tree.Comparator().Name())
 	}
-	db.setMeta(data)
+	db.setMeta(meta)
 	return nil
 }
 
 // Loading meta data from KV data structure to storage
-func updateMeta(db *KV) error {
-	if _, err := syscall.Pwrite(db.fd, db.getMeta(), 0); err != nil {
+// meta goes to the slot of its version, see META_SLOT_SIZE
+func updateMeta(db *KV, meta []byte) error {
+	slot := int64(metaVersion(meta) % 2)
+	if _, err := syscall.Pwrite(db.fd, meta, slot*META_SLOT_SIZE); err != nil {
 		return fmt.Errorf("write meta page: %w", err)
 	}
 	return nil
@@ -0,0 +1,178 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Manik-Jasrai/ByteStore.git/btree"
+	"github.com/stretchr/testify/assert"
+)
+
+// Changes a meta slot of the file and gives it a good crc again
+func rewriteSlot(t *testing.T, path string, slot int, change func(meta []byte)) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	defer f.Close()
+	meta := make([]byte, META_SIZE)
+	_, err = f.ReadAt(meta, int64(slot*META_SLOT_SIZE))
+	assert.NoError(t, err)
+	change(meta)
+	binary.LittleEndian.PutUint32(meta[META_CRC_OFFSET:], crc32.Checksum(meta[:META_CRC_OFFSET], metaTable))
+	_, err = f.WriteAt(meta, int64(slot*META_SLOT_SIZE))
+	assert.NoError(t, err)
+}
+
+func TestMetaFormat(t *testing.T) {
+	db := newKV(t, 10)
+	db.Close()
+	rewriteSlot(t, db.Path, int(db.version%2), func(meta []byte) {
+		binary.LittleEndian.PutUint32(meta[META_FORMAT_OFFSET:], DB_FORMAT+1)
+	})
+	assert.ErrorIs(t, (&KV{Path: db.Path}).Open(), ErrFormat)
+
+	// format 1 has a single slot without a version or crc
+	old := make([]byte, 2*4096)
+	copy(old, DB_SIG)
+	binary.LittleEndian.PutUint64(old[24:], 2)
+	assert.NoError(t, os.WriteFile(db.Path, old, 0o644))
+	err := (&KV{Path: db.Path}).Open()
+	assert.ErrorIs(t, err, ErrFormat)
+	assert.Contains(t, err.Error(), "format 1")
+}
+
+func TestMetaSlotFallback(t *testing.T) {
+	db := newKV(t, 10)
+	version := db.version
+	assert.NoError(t, db.Set([]byte("k0010"), []byte("v0010")))
+	db.Close()
+
+	// the newest slot is torn, the commit before it is used
+	flipByte(t, db.Path, int64((version+1)%2*META_SLOT_SIZE+20))
+	db = reopen(t, db)
+	assert.Equal(t, version, db.version)
+	count, err := db.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), count)
+	_, err = db.Get([]byte("k0010"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Empty(t, db.Verify())
+
+	// the next commit writes over the torn slot
+	assert.NoError(t, db.Set([]byte("k0010"), []byte("v0010")))
+	db = reopen(t, db)
+	assert.Equal(t, version+1, db.version)
+	val, err := db.Get([]byte("k0010"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v0010"), val)
+	db.Close()
+
+	// with both slots bad there is nothing to fall back to
+	flipByte(t, db.Path, 20)
+	flipByte(t, db.Path, META_SLOT_SIZE+20)
+	err = (&KV{Path: db.Path}).Open()
+	var corrupt *btree.ErrCorrupt
+	assert.True(t, errors.As(err, &corrupt), err)
+}
+
+func TestMetaFirstCommitTorn(t *testing.T) {
+	// a new file has the meta page of version 0 before its first commit
+	db := newKV(t, 0)
+	assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	assert.Equal(t, uint64(1), db.version)
+	db.Close()
+	flipByte(t, db.Path, META_SLOT_SIZE+20)
+	db = reopen(t, db)
+	assert.Equal(t, uint64(0), db.version)
+	count, err := db.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), count)
+	assert.Empty(t, db.Verify())
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v")))
+	}
+	db = reopen(t, db)
+	count, err = db.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), count)
+	db.Close()
+
+	// a crash before Open wrote the meta page leaves slots that were never written
+	assert.NoError(t, os.WriteFile(db.Path, make([]byte, 3*btree.BTREE_PAGE_SIZE), 0o644))
+	db = reopen(t, db)
+	assert.Equal(t, uint64(0), db.version)
+	assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	db = reopen(t, db)
+	val, err := db.Get([]byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), val)
+	db.Close()
+
+	db = newKV(t, 10)
+	db.Close()
+	err = (&KV{Path: db.Path, Comparator: reverse{}}).Open()
+	assert.ErrorContains(t, err, `comparator mismatch: file uses "bytewise", opened with "reverse"`)
+}
+
+func TestMetaComparator(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "db"), Comparator: reverse{}}
+	assert.NoError(t, db.Open())
+	assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	db.Close()
+
+	// the keys are in the order of the comparator that wrote them
+	for _, cmp := range []btree.Comparator{nil, btree.BytewiseComparator} {
+		err := (&KV{Path: db.Path, Comparator: cmp}).Open()
+		assert.ErrorContains(t, err, `comparator mismatch: file uses "reverse", opened with "bytewise"`)
+	}
+	db = &KV{Path: db.Path, Comparator: reverse{}}
+	assert.NoError(t, db.Open())
+	val, err := db.Get([]byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), val)
+	db.Close()
+
+	db = newKV(t, 10)
+	db.Close()
+	err = (&KV{Path: db.Path, Comparator: reverse{}}).Open()
+	assert.ErrorContains(t, err, `comparator mismatch: file uses "bytewise", opened with "reverse"`)
+}
+
+func TestMetaPageSize(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "db"), PageSize: 16 << 10}
+	assert.NoError(t, db.Open())
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%04d", i))))
+	}
+	db.Close()
+
+	// the size of the file is used when none is given
+	db = &KV{Path: db.Path}
+	assert.NoError(t, db.Open())
+	assert.Equal(t, 16<<10, db.tree.PageSize())
+	val, err := db.Get([]byte("k0999"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v0999"), val)
+	assert.NoError(t, db.Set([]byte("k1000"), []byte("v1000")))
+	assert.Empty(t, db.Verify())
+	db.Close()
+	info, err := os.Stat(db.Path)
+	assert.NoError(t, err)
+	assert.Zero(t, info.Size()%(16<<10))
+
+	err = (&KV{Path: db.Path, PageSize: 8 << 10}).Open()
+	assert.ErrorContains(t, err, "page size mismatch: file uses 16384, opened with 8192")
+	err = (&KV{Path: db.Path, PageSize: btree.BTREE_PAGE_SIZE}).Open()
+	assert.ErrorContains(t, err, "page size mismatch: file uses 16384, opened with 4096")
+
+	// and the default size is stored as well
+	db = newKV(t, 10)
+	db.Close()
+	err = (&KV{Path: db.Path, PageSize: 16 << 10}).Open()
+	assert.ErrorContains(t, err, "page size mismatch: file uses 4096, opened with 16384")
+}
@@ -6,7 +6,6 @@ import (
 	"os"
 	"syscall"
 
-	"github.com/Manik-Jasrai/ByteStore.git/btree"
 	"github.com/Manik-Jasrai/ByteStore.git/utils"
 )
 
@@ -17,12 +16,13 @@ func mmapInit(db *KV) (int, []byte, error) {
 		return 0, nil, fmt.Errorf("error : %w", err)
 	}
 	size := fi.Size()
-	if size%btree.BTREE_PAGE_SIZE != 0 {
+	page := db.tree.PageSize()
+	if size%int64(page) != 0 {
 		return 0, nil, errors.New("file size is not a multiple of page size")
 	}
 
 	mmapSize := 64 << 20
-	utils.Assert(mmapSize%btree.BTREE_PAGE_SIZE == 0, "MMap size is not a multiple of page size.")
+	utils.Assert(mmapSize%page == 0, "MMap size is not a multiple of page size.")
 	for mmapSize < int(size) {
 		mmapSize *= 2
 	}
@@ -51,6 +51,8 @@ func extendMmap(db *KV, size int) error {
 	}
 
 	db.mmap.total += alloc
+	db.mu.Lock()
 	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	db.mu.Unlock()
 	return nil
 }
@@ -0,0 +1,327 @@
+package kv
+
+import (
+	"fmt"
+	"iter"
+
+	"github.com/Manik-Jasrai/ByteStore.git/btree"
+)
+
+// A write transaction, see KV.Begin
+// its reads see its own updates, the store only sees them once Commit returns
+type Tx struct {
+	db    *KV
+	tree  btree.BTree // the tree of the store with the root of the transaction
+	dirty bool        // something was changed
+	done  bool        // committed or aborted
+
+	// what Abort goes back to
+	free    FreeList
+	updates map[uint64][]byte
+}
+
+// Starts a transaction, it waits for the one in progress to finish
+// reads on the store keep seeing the last commit until it is done, see ReadTx
+func (db *KV) Begin() (*Tx, error) {
+	db.writer.Lock()
+	// Close may have run while we waited
+	if err := db.checkOpen(); err != nil {
+		db.writer.Unlock()
+		return nil, err
+	}
+	// pages freed since the oldest reader began can not be used yet
+	db.mu.Lock()
+	db.free.SetMaxSeq(db.oldestReader())
+	db.mu.Unlock()
+
+	tx := &Tx{db: db, tree: db.tree, free: db.free, updates: map[uint64][]byte{}}
+	// pages still to be written, the free list changes them in place
+	for ptr, node := range db.page.updates {
+		tx.updates[ptr] = append([]byte(nil), node...)
+	}
+	db.tx = tx
+	return tx, nil
+}
+
+// Close waits for the transaction, so the store is open until it is done
+func (tx *Tx) check() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return nil
+}
+
+// Returns ErrNotFound if the key does not exist
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+	return tx.tree.Get(key)
+}
+
+// Iterates over the keys in [start, end) in order, see KV.Scan
+func (tx *Tx) Scan(start []byte, end []byte) iter.Seq2[[]byte, []byte] {
+	return tx.ScanErr(start, end, nil)
+}
+
+// Scan that sets *err to why it stopped early, see KV.ScanErr
+func (tx *Tx) ScanErr(start []byte, end []byte, err *error) iter.Seq2[[]byte, []byte] {
+	if e := tx.check(); e != nil {
+		return func(yield func([]byte, []byte) bool) { setErr(err, e) }
+	}
+	return tx.tree.ScanErr(start, end, err)
+}
+
+func (tx *Tx) Set(key []byte, val []byte) error {
+	_, err := tx.Update(&btree.UpdateReq{Key: key, Val: val})
+	return err
+}
+
+// Inserts or updates a key as req.Mode allows, see KV.Update
+func (tx *Tx) Update(req *btree.UpdateReq) (bool, error) {
+	if err := tx.check(); err != nil {
+		return false, err
+	}
+	if len(req.Key) == 0 {
+		return false, fmt.Errorf("empty key")
+	}
+	updated, err := tx.tree.Update(req)
+	tx.dirty = tx.dirty || updated
+	return updated, err
+}
+
+// Returns ErrNotFound if the key does not exist
+func (tx *Tx) Del(key []byte) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("empty key")
+	}
+	if _, err := tx.tree.Delete(key); err != nil {
+		return err
+	}
+	tx.dirty = true
+	return nil
+}
+
+// Deletes the keys in [start, end) and returns how many there were
+func (tx *Tx) DeleteRange(start []byte, end []byte) (uint64, error) {
+	if err := tx.check(); err != nil {
+		return 0, err
+	}
+	count, err := tx.tree.DeleteRange(start, end)
+	tx.dirty = tx.dirty || count > 0
+	return count, err
+}
+
+// Writes the updates of the transaction to the file with a single sync of the pages and of the meta page
+// if that fails the store is left as it was before Begin
+func (tx *Tx) Commit() error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	db := tx.db
+	tx.done, db.tx = true, nil
+	defer db.writer.Unlock()
+	if !tx.dirty {
+		return nil
+	}
+	root := tx.tree.GetRoot()
+	if err := db.freeReused(); err != nil {
+		tx.revert()
+		return err
+	}
+	if err := updateOrRevert(db, root); err != nil {
+		tx.revert()
+		return err
+	}
+
+	db.mu.Lock()
+	db.tree.SetRoot(root)
+	db.version++
+	db.mu.Unlock()
+	db.free.AddCommit(db.version)
+	return nil
+}
+
+// The pages freed twice go to the free list with the others
+// a corrupt page of the free list is returned as an error, see btree.ErrCorrupt
+func (db *KV) freeReused() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			corrupt, ok := r.(*btree.ErrCorrupt)
+			if !ok {
+				panic(r)
+			}
+			err = corrupt
+		}
+	}()
+	for _, ptr := range db.page.reuse {
+		db.free.PushTail(ptr)
+	}
+	db.page.reuse = db.page.reuse[:0]
+	return nil
+}
+
+// Throws away the updates of the transaction
+// nothing was written to the file, so only the pending pages and the free list go back
+func (tx *Tx) Abort() {
+	if tx.done {
+		return
+	}
+	tx.done, tx.db.tx = true, nil
+	tx.revert()
+	tx.db.writer.Unlock()
+}
+
+// Pending pages and free list as they were at Begin
+func (tx *Tx) revert() {
+	db := tx.db
+	db.free = tx.free
+	db.page.temp = db.page.temp[:0]
+	db.page.updates = tx.updates
+	db.page.reuse = db.page.reuse[:0]
+}
+
+// A read transaction, see KV.BeginRead
+// it sees the store as of the last commit before it began, and runs alongside the write transaction
+// the pages it can see are not reused until Done, and Close waits for it
+// its cursors, Select, SeekLE and SeekGE, can be used until Done
+type ReadTx struct {
+	db      *KV
+	tree    btree.BTree
+	version uint64
+	done    bool
+}
+
+func (db *KV) BeginRead() (*ReadTx, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.open {
+		return nil, ErrClosed
+	}
+	tx := &ReadTx{db: db, tree: db.tree, version: db.version}
+	tx.tree.SetStore(snapshotStore{db: db, chunks: db.mmap.chunks})
+	db.readers[tx.version]++
+	return tx, nil
+}
+
+// Lets the writer reuse the pages only this transaction could see
+func (tx *ReadTx) Done() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	db := tx.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.readers[tx.version]--
+	if db.readers[tx.version] == 0 {
+		delete(db.readers, tx.version)
+	}
+	db.readersDone.Broadcast()
+}
+
+// Close waits for the transaction, see Tx.check
+func (tx *ReadTx) check() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return nil
+}
+
+// Returns ErrNotFound if the key does not exist
+// the value can be used until Done
+func (tx *ReadTx) Get(key []byte) ([]byte, error) {
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+	return tx.tree.Get(key)
+}
+
+// Iterates over the keys in [start, end) in order, see KV.Scan
+func (tx *ReadTx) Scan(start []byte, end []byte) iter.Seq2[[]byte, []byte] {
+	return tx.ScanErr(start, end, nil)
+}
+
+// Scan that sets *err to why it stopped early, see KV.ScanErr
+func (tx *ReadTx) ScanErr(start []byte, end []byte, err *error) iter.Seq2[[]byte, []byte] {
+	if e := tx.check(); e != nil {
+		return func(yield func([]byte, []byte) bool) { setErr(err, e) }
+	}
+	return tx.tree.ScanErr(start, end, err)
+}
+
+// Number of keys in [start, end)
+func (tx *ReadTx) Count(start []byte, end []byte) (uint64, error) {
+	if err := tx.check(); err != nil {
+		return 0, err
+	}
+	return tx.tree.Count(start, end)
+}
+
+// Number of keys < key
+func (tx *ReadTx) Rank(key []byte) (uint64, error) {
+	if err := tx.check(); err != nil {
+		return 0, err
+	}
+	return tx.tree.Rank(key)
+}
+
+// Cursor at the key of rank i, counting from 0, it can be used until Done
+func (tx *ReadTx) Select(i uint64) *btree.BIter {
+	if tx.check() != nil {
+		return &btree.BIter{}
+	}
+	return tx.tree.Select(i)
+}
+
+// Cursor at the largest key <= key, it can be used until Done
+func (tx *ReadTx) SeekLE(key []byte) *btree.BIter {
+	if tx.check() != nil {
+		return &btree.BIter{}
+	}
+	return tx.tree.SeekLE(key)
+}
+
+// Cursor at the smallest key >= key, it can be used until Done
+func (tx *ReadTx) SeekGE(key []byte) *btree.BIter {
+	if tx.check() != nil {
+		return &btree.BIter{}
+	}
+	return tx.tree.SeekGE(key)
+}
+
+// Version of the oldest read transaction, the last commit if there is none
+// db.mu is held
+func (db *KV) oldestReader() uint64 {
+	oldest := db.version
+	for version := range db.readers {
+		oldest = min(oldest, version)
+	}
+	return oldest
+}
+
+// The file as a read transaction sees it
+// a committed tree is all in the file, so the pages of the write transaction are never read
+type snapshotStore struct {
+	db     *KV
+	chunks [][]byte // the mapping when the transaction began
+}
+
+func (store snapshotStore) Get(ptr uint64) []byte {
+	return store.db.pageReadChunks(store.chunks, ptr)
+}
+func (store snapshotStore) New(page []byte) uint64 {
+	panic("read only transaction")
+}
+func (store snapshotStore) Del(ptr uint64) {
+	panic("read only transaction")
+}
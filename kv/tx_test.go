@@ -0,0 +1,227 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sync"
+	"testing"
+
+	"github.com/Manik-Jasrai/ByteStore.git/btree"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxReadsOwnWrites(t *testing.T) {
+	db := newKV(t, 10)
+	defer db.Close()
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Set([]byte("k0100"), []byte("new")))
+	assert.NoError(t, tx.Del([]byte("k0001")))
+
+	val, err := tx.Get([]byte("k0100"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(val))
+	_, err = tx.Get([]byte("k0001"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	n := 0
+	for range tx.Scan(nil, nil) {
+		n++
+	}
+	assert.Equal(t, 10, n)
+
+	// the store sees the last commit until Commit returns
+	_, err = db.Get([]byte("k0100"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = db.Get([]byte("k0001"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, tx.Commit())
+	assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+	_, err = db.Get([]byte("k0001"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	val, err = db.Get([]byte("k0100"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(val))
+}
+
+// Pending pages and free list of the store, what Abort goes back to
+func pending(db *KV) ([5]uint64, map[uint64]string) {
+	updates := map[uint64]string{}
+	for ptr, node := range db.page.updates {
+		updates[ptr] = string(node)
+	}
+	fl := db.free
+	return [5]uint64{fl.headPage, fl.headSeq, fl.tailPage, fl.tailSeq, fl.maxSeq}, updates
+}
+
+func TestTxAbort(t *testing.T) {
+	// an empty store, and one with pages on its free list
+	for _, n := range []int{0, 1000} {
+		db := newKV(t, n)
+		root := db.tree.GetRoot()
+		tx, err := db.Begin()
+		assert.NoError(t, err)
+		free, updates := pending(db)
+		for i := 0; i < 2000; i++ {
+			assert.NoError(t, tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("aborted")))
+		}
+		_, err = tx.DeleteRange([]byte("k0500"), []byte("k1500"))
+		assert.NoError(t, err)
+		tx.Abort()
+		assert.ErrorIs(t, tx.Set([]byte("k"), []byte("v")), ErrTxDone)
+
+		after, afterUpdates := pending(db)
+		assert.Equal(t, free, after)
+		assert.True(t, maps.Equal(updates, afterUpdates))
+		assert.Empty(t, db.page.temp)
+		assert.Empty(t, db.page.reuse)
+		assert.Equal(t, root, db.tree.GetRoot())
+		count, err := db.Count(nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(n), count)
+
+		// the next transaction starts from there
+		assert.NoError(t, db.Set([]byte("k9999"), []byte("v9999")))
+		db = reopen(t, db)
+		count, err = db.Count(nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(n+1), count)
+		assert.Empty(t, db.Verify())
+		db.Close()
+	}
+}
+
+// A free list page that can not be read fails the commit instead of panicking
+func TestTxCommitCorruptFreeList(t *testing.T) {
+	db := newKV(t, 100)
+	defer db.Close()
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	// the second update frees pages the first one wrote, they go to the free list on commit
+	assert.NoError(t, tx.Set([]byte("k0100"), []byte("v0100")))
+	assert.NoError(t, tx.Set([]byte("k0101"), []byte("v0101")))
+	assert.NotEmpty(t, db.page.reuse)
+	db.free.tailPage = 1 << 40
+
+	assert.ErrorIs(t, tx.Commit(), &ErrCorrupt{})
+	assert.NotEqual(t, uint64(1<<40), db.free.tailPage)
+	_, err = db.Get([]byte("k0100"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, db.Set([]byte("k0100"), []byte("v0100")))
+	count, err := db.Count(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(101), count)
+	assert.Empty(t, db.Verify())
+}
+
+// Readers see a single commit each while a writer rewrites every key, run with -race
+func TestReadTxSnapshot(t *testing.T) {
+	db := newKV(t, 0)
+	defer db.Close()
+	const N = 200
+	write := func(gen int) {
+		tx, err := db.Begin()
+		assert.NoError(t, err)
+		for i := 0; i < N; i++ {
+			assert.NoError(t, tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("%06d-%0100d", gen, i))))
+		}
+		assert.NoError(t, tx.Commit())
+	}
+	write(0)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tx, err := db.BeginRead()
+				if !assert.NoError(t, err) {
+					return
+				}
+				// twice, the writer commits in between
+				gen, n := "", 0
+				for pass := 0; pass < 2; pass++ {
+					for _, v := range tx.Scan(nil, nil) {
+						if gen == "" {
+							gen = string(v[:6])
+						}
+						assert.Equal(t, gen, string(v[:6]))
+						n++
+					}
+				}
+				assert.Equal(t, 2*N, n)
+				tx.Done()
+			}
+		}()
+	}
+	for gen := 1; gen < 30; gen++ {
+		write(gen)
+	}
+	close(stop)
+	wg.Wait()
+	assert.Empty(t, db.Verify())
+}
+
+// Pages of a tree, from its dump
+func treePages(t *testing.T, tree *btree.BTree) []uint64 {
+	var buf bytes.Buffer
+	assert.NoError(t, tree.Dump(&buf, btree.DUMP_JSON))
+	var dump struct{ Pages []struct{ Ptr uint64 } }
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &dump))
+	ptrs := []uint64{}
+	for _, page := range dump.Pages {
+		ptrs = append(ptrs, page.Ptr)
+	}
+	return ptrs
+}
+
+// Pages a reader can see are not reused until it is done
+func TestReadTxPinsPages(t *testing.T) {
+	db := newKV(t, 300)
+	defer db.Close()
+	tx, err := db.BeginRead()
+	assert.NoError(t, err)
+	pinned := map[uint64]string{}
+	for _, ptr := range treePages(t, &tx.tree) {
+		pinned[ptr] = string(tx.tree.Store().Get(ptr))
+	}
+	changed := func() int {
+		n := 0
+		for ptr, page := range pinned {
+			if string(db.pageReadFile(ptr)) != page {
+				n++
+			}
+		}
+		return n
+	}
+
+	// every key is rewritten a few times, so the pages the reader sees are all freed
+	setAll := func(val string) {
+		tx, err := db.Begin()
+		assert.NoError(t, err)
+		for i := 0; i < 300; i++ {
+			assert.NoError(t, tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(val)))
+		}
+		assert.NoError(t, tx.Commit())
+	}
+	for gen := 0; gen < 5; gen++ {
+		setAll(fmt.Sprintf("g%d", gen))
+	}
+	assert.Equal(t, 0, changed())
+	val, err := tx.Get([]byte("k0001"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v0001", string(val))
+
+	tx.Done()
+	setAll("again")
+	assert.Greater(t, changed(), 0)
+}